@@ -0,0 +1,171 @@
+// Package agentapi 实现了 broker 回调 agent 的 /api/v1/agent/* 接口（见 docs/api.yaml），
+// 将报文解析为类型化的结构体后分发给 Callbacks。
+//
+//	type callbacks struct {
+//		agentapi.UnimplementedCallbacks
+//	}
+//
+//	func (callbacks) ThirdDiff(ctx context.Context, diff *agentapi.ThirdDiff) error { ... }
+//
+//	mux := http.NewServeMux()
+//	mux.Handle("/api/v1/agent/", agentapi.NewHandler(callbacks{}))
+//	tun, err := tunnel.Dial(ctx, hide, &http.Server{Handler: mux})
+package agentapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// Callbacks broker 回调 agent 的接口，不需要处理的回调可以嵌入 UnimplementedCallbacks。
+type Callbacks interface {
+	// Startup startup 配置更新。
+	Startup(ctx context.Context, startup *Startup) error
+
+	// TaskDiff 中心端配置变更，返回变更后的配置运行状态。
+	TaskDiff(ctx context.Context, diff *TaskDiff) (*TaskReport, error)
+
+	// TaskStatus 中心端抓取配置运行状态。
+	TaskStatus(ctx context.Context) (*TaskReport, error)
+
+	// ThirdDiff 三方文件发生变化。
+	ThirdDiff(ctx context.Context, diff *ThirdDiff) error
+
+	// NoticeUpgrade 升级通知。
+	NoticeUpgrade(ctx context.Context, notice *UpgradeNotice) error
+
+	// NoticeCommand 命令通知。
+	NoticeCommand(ctx context.Context, notice *CommandNotice) error
+}
+
+// ErrNotImplemented 回调未实现，响应 501。
+var ErrNotImplemented = errors.New("回调未实现")
+
+// UnimplementedCallbacks 所有回调都返回 ErrNotImplemented。
+type UnimplementedCallbacks struct{}
+
+func (UnimplementedCallbacks) Startup(context.Context, *Startup) error { return ErrNotImplemented }
+
+func (UnimplementedCallbacks) TaskDiff(context.Context, *TaskDiff) (*TaskReport, error) {
+	return nil, ErrNotImplemented
+}
+
+func (UnimplementedCallbacks) TaskStatus(context.Context) (*TaskReport, error) {
+	return nil, ErrNotImplemented
+}
+
+func (UnimplementedCallbacks) ThirdDiff(context.Context, *ThirdDiff) error { return ErrNotImplemented }
+
+func (UnimplementedCallbacks) NoticeUpgrade(context.Context, *UpgradeNotice) error {
+	return ErrNotImplemented
+}
+
+func (UnimplementedCallbacks) NoticeCommand(context.Context, *CommandNotice) error {
+	return ErrNotImplemented
+}
+
+// maxBodySize 请求报文的最大长度。
+const maxBodySize = 32 << 20
+
+// NewHandler 创建处理 /api/v1/agent/* 回调的 http.Handler，可以挂载到 Dial 时传入的
+// 任意 Server 中（net/http 直接挂载，其它框架可以通过各自的适配方法包装）。
+//
+// 报文格式错误或缺少必填字段时响应 400，回调返回 ErrNotImplemented 时响应 501，
+// 返回其它错误时响应 500，错误信息以 {"message": "..."} 的格式返回。
+func NewHandler(cb Callbacks) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/agent/startup", func(w http.ResponseWriter, r *http.Request) {
+		req := new(Startup)
+		if decode(w, r, req) {
+			reply(w, nil, cb.Startup(r.Context(), req))
+		}
+	})
+	mux.HandleFunc("POST /api/v1/agent/task/diff", func(w http.ResponseWriter, r *http.Request) {
+		req := new(TaskDiff)
+		if decode(w, r, req) {
+			res, err := cb.TaskDiff(r.Context(), req)
+			replyReport(w, res, err)
+		}
+	})
+	mux.HandleFunc("POST /api/v1/agent/task/status", func(w http.ResponseWriter, r *http.Request) {
+		res, err := cb.TaskStatus(r.Context())
+		replyReport(w, res, err)
+	})
+	mux.HandleFunc("POST /api/v1/agent/third/diff", func(w http.ResponseWriter, r *http.Request) {
+		req := new(ThirdDiff)
+		if !decode(w, r, req) {
+			return
+		}
+		if req.Name == "" || (req.Event != ThirdUpdate && req.Event != ThirdDelete) {
+			writeError(w, http.StatusBadRequest, "name 不能为空，event 必须是 update 或 delete")
+			return
+		}
+		reply(w, nil, cb.ThirdDiff(r.Context(), req))
+	})
+	mux.HandleFunc("POST /api/v1/agent/notice/upgrade", func(w http.ResponseWriter, r *http.Request) {
+		req := new(UpgradeNotice)
+		if decode(w, r, req) {
+			reply(w, nil, cb.NoticeUpgrade(r.Context(), req))
+		}
+	})
+	mux.HandleFunc("POST /api/v1/agent/notice/command", func(w http.ResponseWriter, r *http.Request) {
+		req := new(CommandNotice)
+		if !decode(w, r, req) {
+			return
+		}
+		if req.Cmd == "" {
+			writeError(w, http.StatusBadRequest, "cmd 不能为空")
+			return
+		}
+		reply(w, nil, cb.NoticeCommand(r.Context(), req))
+	})
+
+	return mux
+}
+
+// decode 解析 JSON 报文，失败时响应 400 并返回 false。空报文视为零值。
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(v)
+	if err == nil || errors.Is(err, io.EOF) {
+		return true
+	}
+	writeError(w, http.StatusBadRequest, "报文格式错误："+err.Error())
+
+	return false
+}
+
+// reply 根据回调的结果响应。
+func reply(w http.ResponseWriter, res any, err error) {
+	if errors.Is(err, ErrNotImplemented) {
+		writeError(w, http.StatusNotImplemented, err.Error())
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if res == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// replyReport 回调返回 nil 时不响应报文，避免被编码为 null。
+func replyReport(w http.ResponseWriter, res *TaskReport, err error) {
+	if res == nil {
+		reply(w, nil, err)
+	} else {
+		reply(w, res, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": msg})
+}
@@ -0,0 +1,64 @@
+package agentapi_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vela-ssoc/vela-tunnel/agentapi"
+)
+
+type callbacks struct {
+	agentapi.UnimplementedCallbacks
+	third *agentapi.ThirdDiff
+}
+
+func (cb *callbacks) ThirdDiff(_ context.Context, diff *agentapi.ThirdDiff) error {
+	cb.third = diff
+	return nil
+}
+
+func (cb *callbacks) TaskStatus(context.Context) (*agentapi.TaskReport, error) {
+	return &agentapi.TaskReport{Tasks: []*agentapi.TaskStatus{{ID: 1, Name: "kafka"}}}, nil
+}
+
+func TestHandler(t *testing.T) {
+	cb := new(callbacks)
+	srv := httptest.NewServer(agentapi.NewHandler(cb))
+	defer srv.Close()
+
+	post := func(path, body string) (int, string) {
+		res, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		dat, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(dat)
+	}
+
+	if code, _ := post("/api/v1/agent/third/diff", `{"name":"ip2region.db","event":"update"}`); code != http.StatusOK {
+		t.Fatalf("期望 200，实际 %d", code)
+	}
+	if cb.third == nil || cb.third.Name != "ip2region.db" || cb.third.Event != agentapi.ThirdUpdate {
+		t.Fatalf("回调参数错误：%+v", cb.third)
+	}
+	if code, _ := post("/api/v1/agent/third/diff", `{"name":"ip2region.db","event":"rename"}`); code != http.StatusBadRequest {
+		t.Fatalf("期望 400，实际 %d", code)
+	}
+	if code, _ := post("/api/v1/agent/task/diff", `{"removes":[`); code != http.StatusBadRequest {
+		t.Fatalf("期望 400，实际 %d", code)
+	}
+	if code, body := post("/api/v1/agent/task/status", ""); code != http.StatusOK || !strings.Contains(body, `"name":"kafka"`) {
+		t.Fatalf("响应错误：%d %s", code, body)
+	}
+	if code, _ := post("/api/v1/agent/notice/upgrade", `{"version":"1.2.3"}`); code != http.StatusNotImplemented {
+		t.Fatalf("期望 501，实际 %d", code)
+	}
+	if code, _ := post("/api/v1/agent/notice/command", `{}`); code != http.StatusBadRequest {
+		t.Fatalf("期望 400，实际 %d", code)
+	}
+}
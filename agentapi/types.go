@@ -0,0 +1,107 @@
+package agentapi
+
+import "time"
+
+// Startup startup 配置。
+type Startup struct {
+	Node    StartupNode      `json:"node"`
+	Logger  StartupLogger    `json:"logger"`
+	Console StartupConsole   `json:"console"`
+	Extends []*StartupExtend `json:"extends"`
+}
+
+// StartupNode 节点配置。
+type StartupNode struct {
+	DNS    string `json:"dns"`
+	Prefix string `json:"prefix"`
+}
+
+// StartupLogger 日志配置。
+type StartupLogger struct {
+	Level    string `json:"level"` // 日志级别 debug/info/error
+	Filename string `json:"filename"`
+	Console  bool   `json:"console"`
+	Format   string `json:"format"` // 日志格式 text/json
+	Caller   bool   `json:"caller"` // 是否打印调用函数名字
+	Skip     int    `json:"skip"`
+}
+
+// StartupConsole 控制台配置。
+type StartupConsole struct {
+	Enable  bool   `json:"enable"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Script  string `json:"script"`
+}
+
+// StartupExtend 扩展配置。
+type StartupExtend struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"` // number bool string ref string_readonly
+	Value string `json:"value"`
+}
+
+// TaskDiff 中心端比对后下发的配置差异。
+type TaskDiff struct {
+	Removes []int64      `json:"removes"`
+	Updates []*TaskChunk `json:"updates"`
+}
+
+// TaskChunk 需要更新的配置。
+type TaskChunk struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Dialect bool   `json:"dialect"`
+	Hash    string `json:"hash"`
+	Chunk   []byte `json:"chunk"` // 配置脚本
+}
+
+// TaskReport agent 上的配置运行状态。
+type TaskReport struct {
+	Tasks []*TaskStatus `json:"tasks"`
+}
+
+// TaskStatus 配置的运行状态。
+type TaskStatus struct {
+	ID      int64         `json:"id"`
+	Name    string        `json:"name"`
+	Dialect bool          `json:"dialect"`
+	Hash    string        `json:"hash"`
+	Uptime  time.Time     `json:"uptime"`
+	From    string        `json:"from"`
+	Runners []*TaskRunner `json:"runners"`
+}
+
+// TaskRunner 配置中的服务。
+type TaskRunner struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// 三方文件的变化类型。
+const (
+	ThirdUpdate = "update"
+	ThirdDelete = "delete"
+)
+
+// ThirdDiff 三方文件变化通知。
+type ThirdDiff struct {
+	Name  string `json:"name"`  // 发生变化的文件名
+	Event string `json:"event"` // 变化类型 ThirdUpdate ThirdDelete
+}
+
+// UpgradeNotice 升级通知，收到通知后可以调用 brokerapi.Client.UpgradeDownload 检查更新。
+type UpgradeNotice struct {
+	Version string `json:"version"` // 为空代表升级到最新版，不为空代表升级到指定版本（可能是降级）
+}
+
+// 命令通知中的命令。
+const (
+	CommandOffline = "offline" // 节点重启
+)
+
+// CommandNotice 命令通知。
+type CommandNotice struct {
+	Cmd string `json:"cmd"`
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff 重连退避策略。
+//
+// 连接 broker 失败后会调用 Next 计算下次重试前需要等待的时长；
+// 连接成功且稳定保持一段时间后（见 WithBackoffReset）会调用 Reset 重置退避状态。
+// Backoff 只会在重连协程中被调用，实现者无需考虑并发安全。
+type Backoff interface {
+	// Next 下次重试前需要等待的时长。
+	Next() time.Duration
+
+	// Reset 重置退避状态。
+	Reset()
+}
+
+// NewLadderBackoff 阶梯式退避策略，根据距离第一次重试的时长决定等待间隔，
+// 这是默认的退避策略。
+//
+// 时长：0  3min 10min 30min        1h         12h                      ∞
+// 图例：└──┴────┴───────┴──────────┴───────────┴───────────────────────┘
+// 结果： 3s  10s   30s      1min        5min              10min
+func NewLadderBackoff() Backoff {
+	return new(ladderBackoff)
+}
+
+// NewExponentialBackoff 指数退避 + 全抖动（full jitter）策略。
+//
+// 第 n 次重试等待 [0, min(maximum, base*2^n)] 之间的随机时长，大量节点同时掉线时
+// 可以将重连打散，避免 broker 重启后所有节点同一时刻涌入。
+func NewExponentialBackoff(base, maximum time.Duration) Backoff {
+	base, maximum = backoffBounds(base, maximum)
+	return &exponentialBackoff{base: base, max: maximum}
+}
+
+// NewDecorrelatedBackoff 去相关抖动（decorrelated jitter）策略。
+//
+// 每次等待 [base, 上次等待时长*3] 之间的随机时长，且不超过 maximum。
+func NewDecorrelatedBackoff(base, maximum time.Duration) Backoff {
+	base, maximum = backoffBounds(base, maximum)
+	return &decorrelatedBackoff{base: base, max: maximum, last: base}
+}
+
+type ladderBackoff struct {
+	start time.Time // 第一次重试的时间
+}
+
+func (lb *ladderBackoff) Next() time.Duration {
+	if lb.start.IsZero() {
+		lb.start = time.Now()
+	}
+
+	interval := time.Since(lb.start)
+	switch {
+	case interval < 3*time.Minute:
+		return 3 * time.Second
+	case interval < 10*time.Minute:
+		return 10 * time.Second
+	case interval < 30*time.Minute:
+		return 30 * time.Second
+	case interval < time.Hour:
+		return time.Minute
+	case interval < 12*time.Hour:
+		return 5 * time.Minute
+	default:
+		return 10 * time.Minute
+	}
+}
+
+func (lb *ladderBackoff) Reset() {
+	lb.start = time.Time{}
+}
+
+type exponentialBackoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func (eb *exponentialBackoff) Next() time.Duration {
+	ceil := eb.max
+	if eb.attempt < 62 {
+		if du := eb.base << eb.attempt; du > 0 && du < ceil {
+			ceil = du
+		}
+	}
+	eb.attempt++
+
+	return rand.N(ceil + 1)
+}
+
+func (eb *exponentialBackoff) Reset() {
+	eb.attempt = 0
+}
+
+type decorrelatedBackoff struct {
+	base time.Duration
+	max  time.Duration
+	last time.Duration
+}
+
+func (db *decorrelatedBackoff) Next() time.Duration {
+	ceil := db.last * 3
+	if ceil <= 0 || ceil > db.max {
+		ceil = db.max
+	}
+	du := db.base
+	if ceil > db.base {
+		du += rand.N(ceil - db.base + 1)
+	}
+	db.last = du
+
+	return du
+}
+
+func (db *decorrelatedBackoff) Reset() {
+	db.last = db.base
+}
+
+// backoffBounds 修正退避参数。
+func backoffBounds(base, maximum time.Duration) (time.Duration, time.Duration) {
+	if base <= 0 {
+		base = time.Second
+	}
+	if maximum < base {
+		maximum = base
+	}
+	return base, maximum
+}
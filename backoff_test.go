@@ -0,0 +1,55 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLadderBackoff(t *testing.T) {
+	lb := new(ladderBackoff)
+	if du := lb.Next(); du != 3*time.Second {
+		t.Fatalf("首次重试期望等待 3s，实际 %s", du)
+	}
+
+	lb.start = time.Now().Add(-2 * time.Hour)
+	if du := lb.Next(); du != 5*time.Minute {
+		t.Fatalf("重试 2h 后期望等待 5min，实际 %s", du)
+	}
+
+	lb.Reset()
+	if du := lb.Next(); du != 3*time.Second {
+		t.Fatalf("重置后期望等待 3s，实际 %s", du)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	base, maximum := 100*time.Millisecond, 2*time.Second
+	eb := NewExponentialBackoff(base, maximum)
+	for i := 0; i < 100; i++ {
+		ceil := maximum
+		if i < 5 {
+			ceil = base << i
+		}
+		if du := eb.Next(); du < 0 || du > ceil {
+			t.Fatalf("第 %d 次重试等待 %s 超出范围 [0, %s]", i, du, ceil)
+		}
+	}
+
+	eb.Reset()
+	if du := eb.Next(); du > base {
+		t.Fatalf("重置后期望等待不超过 %s，实际 %s", base, du)
+	}
+}
+
+func TestDecorrelatedBackoff(t *testing.T) {
+	base, maximum := 100*time.Millisecond, 2*time.Second
+	db := NewDecorrelatedBackoff(base, maximum)
+	last := base
+	for i := 0; i < 100; i++ {
+		du := db.Next()
+		if du < base || du > min(maximum, last*3) {
+			t.Fatalf("第 %d 次重试等待 %s 超出范围 [%s, %s]", i, du, base, min(maximum, last*3))
+		}
+		last = du
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -27,25 +29,50 @@ type borerTunnel struct {
 	issue    Issue              // issue
 	mident   Identifier         // 机器码
 	ntf      Notifier           // 事件通知
-	interval time.Duration      // 心跳间隔
+	heart    *Heartbeat         // 心跳
+	backoff  Backoff            // 重连退避策略
+	stable   time.Duration      // 连接保持该时长后重置退避策略
+	wait     time.Duration      // 通道未连接时 DialContext 的最长等待时长
 	dialer   dialer             // TCP 连接器
 	coder    Coder              // JSON 编解码器
 	brkAddr  *Address           // 当前连接的 broker 节点地址
 	laddr    net.Addr           // socket 连接本地地址
 	raddr    net.Addr           // socket 连接的远端地址
 	muxer    *smux.Session      // 底层流复用
+	mux      smux.Config        // 流复用参数，每次重连时复制使用
 	client   netutil.HTTPClient // http 客户端
+	trip     *http.Transport    // http 客户端底层连接池
+	httpCli  *http.Client       // HTTPClient 返回的客户端
+	httpTrip *http.Transport    // httpCli 底层连接池
 	stream   netutil.Streamer   // 建立流式通道用
 	slog     Logger             // 日志输出组件
 	parent   context.Context    // parent context.Context
+	quit     context.CancelFunc // 停止重连与心跳
+	unwatch  func() bool        // 停止监听 Dial 传入的 context
 	ctx      context.Context    // context.Context
 	cancel   context.CancelFunc // context.CancelFunc
 	recreate bool               // 是否已经重新生成机器码
+	state    stateMachine       // 连接状态
+	srv      Server             // 处理 broker 请求的服务
+	pump     *sessionPump       // 当前会话的流接收器
+	hub      *streamHub         // 汇聚 broker 发起的流
+	fallback *hubListener       // 默认 Server 的监听器，调用 Listener 后关闭
+	userLn   *hubListener       // Listener 返回的监听器
+	lnOnce   sync.Once          // 保证 Listener 只创建一次
+	seq      uint64             // 会话序号，每次连接成功加 1
+	services *ServiceRegistry   // 本地服务注册表
+	outbox   *Outbox            // 离线上报队列，未开启时为 nil
+	replays  atomic.Bool        // 是否正在重放离线上报
+	mutex    sync.RWMutex       // 保护连接相关的字段
+	ready    chan struct{}      // 会话可用时关闭，会话断开后重新创建
+	done     chan struct{}      // guard 协程退出时关闭
+	notified atomic.Bool        // 保证 Notifier.Shutdown 只通知一次
+	notifies atomic.Int32       // 正在执行的 Notifier 回调数，回调中可能会调用 Close
 }
 
 // ID 节点 ID
 func (bt *borerTunnel) ID() int64 {
-	return bt.issue.ID
+	return bt.Issue().ID
 }
 
 // Inet 出口网卡的 IP 地址
@@ -65,22 +92,44 @@ func (bt *borerTunnel) Ident() Ident {
 
 // Issue 中心端认证成功后返回的信息
 func (bt *borerTunnel) Issue() Issue {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
 	return bt.issue
 }
 
 // BrkAddr 当前连接的 broker 地址
 func (bt *borerTunnel) BrkAddr() *Address {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
 	return bt.brkAddr
 }
 
 func (bt *borerTunnel) LocalAddr() net.Addr {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
 	return bt.laddr
 }
 
 func (bt *borerTunnel) RemoteAddr() net.Addr {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
 	return bt.raddr
 }
 
+// State 当前连接状态
+func (bt *borerTunnel) State() State {
+	return bt.state.State()
+}
+
+// Subscribe 订阅连接状态变更
+func (bt *borerTunnel) Subscribe(ctx context.Context) <-chan StateEvent {
+	return bt.state.Subscribe(ctx)
+}
+
 // NodeName 生成的节点名字
 func (bt *borerTunnel) NodeName() string {
 	return fmt.Sprintf("minion-%s-%d", bt.Inet(), bt.ID())
@@ -93,6 +142,17 @@ func (bt *borerTunnel) Fetch(ctx context.Context, path string, rd io.Reader, hea
 
 // Oneway 单向请求，不关心返回的数据
 func (bt *borerTunnel) Oneway(ctx context.Context, path string, rd io.Reader, header http.Header) error {
+	if bt.outbox != nil {
+		var body []byte
+		if rd != nil {
+			var err error
+			if body, err = io.ReadAll(rd); err != nil {
+				return err
+			}
+		}
+		return bt.report(ctx, path, body, header)
+	}
+
 	res, err := bt.fetch(ctx, http.MethodPost, path, rd, header)
 	if err == nil {
 		return res.Body.Close()
@@ -114,6 +174,15 @@ func (bt *borerTunnel) JSON(ctx context.Context, path string, body, resp any) er
 
 // OnewayJSON 单向请求 json 数据，不关心返回数据
 func (bt *borerTunnel) OnewayJSON(ctx context.Context, path string, req any) error {
+	if bt.outbox != nil {
+		buf := new(bytes.Buffer)
+		if err := bt.coder.NewEncoder(buf).Encode(req); err != nil {
+			return err
+		}
+		header := http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+		return bt.report(ctx, path, buf.Bytes(), header)
+	}
+
 	res, err := bt.fetchJSON(ctx, path, req)
 	if err == nil {
 		_ = res.Body.Close()
@@ -121,6 +190,96 @@ func (bt *borerTunnel) OnewayJSON(ctx context.Context, path string, req any) err
 	return err
 }
 
+// report 开启离线队列后的单向上报：通道正常且队列为空时直接发送，否则入队等待重放。
+// broker 响应了 4xx 时直接返回错误，不会入队；响应 5xx 时与重放一样入队稍后重试。
+func (bt *borerTunnel) report(ctx context.Context, path string, body []byte, header http.Header) error {
+	if bt.State() == StateConnected && bt.outbox.Len() == 0 {
+		res, err := bt.fetch(ctx, http.MethodPost, path, bytes.NewReader(body), header)
+		if err == nil {
+			return res.Body.Close()
+		}
+		if he, ok := err.(*netutil.HTTPError); ok && he.Code < http.StatusInternalServerError {
+			return err
+		}
+	}
+
+	if err := bt.outbox.push(path, header, body); err != nil {
+		return err
+	}
+	if bt.State() == StateConnected {
+		go bt.replay()
+	}
+
+	return nil
+}
+
+// replay 按照优先级与入队顺序重放离线上报，同一时刻只有一个协程在重放。
+// broker 异常导致重放中断时按照 1s、2s、4s ... 最长 1min 的间隔重试，
+// 通道断开时停止重放，重连后再继续。
+func (bt *borerTunnel) replay() {
+	delay := time.Second
+	for bt.outbox.Len() != 0 && bt.replays.CompareAndSwap(false, true) {
+		done := bt.replayOnce()
+		if done {
+			delay = time.Second
+		} else if bt.State() == StateConnected && bt.sleep(delay) == nil {
+			done = true
+			delay = min(2*delay, time.Minute)
+		}
+		bt.replays.Store(false)
+		if !done {
+			return
+		}
+	}
+}
+
+// sleep 等待 du，通道关闭时提前返回错误。
+func (bt *borerTunnel) sleep(du time.Duration) error {
+	timer := time.NewTimer(du)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-bt.parent.Done():
+		return bt.parent.Err()
+	}
+}
+
+// replayOnce 重放当前队列中的上报，通道断开或 broker 异常导致重放中断时返回 false。
+func (bt *borerTunnel) replayOnce() bool {
+	for _, it := range bt.outbox.pending() {
+		if bt.parent.Err() != nil || bt.State() != StateConnected {
+			return false
+		}
+		rec, err := bt.outbox.read(it)
+		if err != nil {
+			bt.slog.Warnf("读取离线上报 %s 错误，丢弃：%s", it.path, err)
+			bt.outbox.remove(it)
+			continue
+		} else if rec == nil { // 已被移除
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(bt.parent, 30*time.Second)
+		res, err := bt.fetch(ctx, http.MethodPost, rec.Path, bytes.NewReader(rec.Body), rec.Header)
+		cancel()
+		if err == nil {
+			_ = res.Body.Close()
+			bt.outbox.remove(it)
+			continue
+		}
+		if he, ok := err.(*netutil.HTTPError); ok && he.Code < http.StatusInternalServerError {
+			bt.slog.Warnf("离线上报 %s 被 broker 拒绝，丢弃：%s", rec.Path, err)
+			bt.outbox.remove(it)
+			continue
+		}
+		bt.slog.Warnf("重放离线上报 %s 错误，稍后重试：%s", rec.Path, err)
+		return false
+	}
+
+	return true
+}
+
 // Attachment 下载文件
 func (bt *borerTunnel) Attachment(parent context.Context, path string, timeouts ...time.Duration) (*Attachment, error) {
 	if parent == nil {
@@ -180,6 +339,17 @@ func (bt *borerTunnel) DialContext(ctx context.Context, network, address string)
 	return bt.dialContext(ctx, network, address)
 }
 
+// HTTPClient 经由通道访问 broker 接口的 HTTP 客户端
+func (bt *borerTunnel) HTTPClient() *http.Client {
+	return bt.httpCli
+}
+
+// flushIdle 关闭连接池中的空闲连接，这些连接是旧会话上的流，会话变更后已不可用。
+func (bt *borerTunnel) flushIdle() {
+	bt.trip.CloseIdleConnections()
+	bt.httpTrip.CloseIdleConnections()
+}
+
 func (bt *borerTunnel) fetchJSON(ctx context.Context, path string, req any) (*http.Response, error) {
 	buf := new(bytes.Buffer)
 	if err := bt.coder.NewEncoder(buf).Encode(req); err != nil {
@@ -220,89 +390,154 @@ func (bt *borerTunnel) newURL(scheme, path string) string {
 	return u.String()
 }
 
-func (bt *borerTunnel) dialContext(context.Context, string, string) (net.Conn, error) {
-	if stream, err := bt.muxer.OpenStream(); err != nil {
-		return nil, err // 防止 *smux.Stream(nil)
-	} else {
-		return stream, nil
-	}
+// session 当前的底层会话
+func (bt *borerTunnel) session() *smux.Session {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+
+	return bt.muxer
 }
 
-func (bt *borerTunnel) heartbeat(inter time.Duration) {
-	const maximum = 5      // 心跳连续错误次数
-	timeout := time.Minute // 每次心跳包发送的超时时间
-	var total uint64       // 心跳包发送失败总次数
-	var sum int            // 心跳包发送失败连续次数
-	var over bool          // 是否终止不再发送心跳包
+func (bt *borerTunnel) dialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	ticker := time.NewTicker(inter)
-	defer ticker.Stop()
+	var expired <-chan time.Time
+	if bt.wait > 0 {
+		timer := time.NewTimer(bt.wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		bt.mutex.RLock()
+		sess, ready := bt.muxer, bt.ready
+		bt.mutex.RUnlock()
+
+		if sess != nil && !sess.IsClosed() {
+			if stream, err := sess.OpenStream(); err != nil {
+				if bt.wait <= 0 {
+					return nil, err // 防止 *smux.Stream(nil)
+				}
+			} else {
+				return stream, nil
+			}
+		}
+		if bt.wait <= 0 {
+			return nil, ErrDisconnected
+		}
+		if sess != nil {
+			ready = bt.unready(sess)
+		}
 
-	for !over {
 		select {
+		case <-ready:
+		case <-expired:
+			return nil, ErrDisconnected
 		case <-bt.parent.Done():
-			over = true
-		case <-ticker.C:
-			err := bt.heartbeatSend(timeout)
-			if err == nil {
-				sum = 0 // 发送成功就将连续错误次数置为 0
-				break
-			}
+			return nil, ErrTunnelClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
 
-			total++
-			sum++
-			if sum >= maximum {
-				sum = 0
-				bt.slog.Warnf("连续 %d 次（总共失败 %d 次）心跳包发送失败：%s，主动断开连接", sum, total, err)
-				_ = bt.muxer.Close()
-			} else {
-				bt.slog.Warnf("心跳包连续第 %d 次（总共失败 %d 次）发送失败：%s", sum, total, err)
-			}
+// awaitSession 等待通道上有可用的会话，直至 ctx 结束或者通道关闭。
+func (bt *borerTunnel) awaitSession(ctx context.Context) error {
+	for {
+		bt.mutex.RLock()
+		sess, ready := bt.muxer, bt.ready
+		bt.mutex.RUnlock()
+		if sess != nil && !sess.IsClosed() {
+			return nil
+		}
+		if sess != nil {
+			ready = bt.unready(sess)
+		}
+
+		select {
+		case <-ready:
+		case <-bt.parent.Done():
+			return ErrTunnelClosed
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
 }
 
-func (bt *borerTunnel) heartbeatSend(timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(bt.parent, timeout)
-	defer cancel()
+// unready 会话 dead 已经断开，返回等待下一个会话可用的 channel。
+func (bt *borerTunnel) unready(dead *smux.Session) chan struct{} {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
 
-	return bt.Oneway(ctx, "/api/v1/minion/ping", nil, nil)
+	if bt.muxer == dead {
+		select {
+		case <-bt.ready:
+			bt.ready = make(chan struct{})
+		default:
+		}
+	}
+
+	return bt.ready
 }
 
 func (bt *borerTunnel) dial() error {
 	bt.ctx, bt.cancel = context.WithCancel(bt.parent)
-	start := time.Now()
 	timeout := 5 * time.Second
 
 	bt.slog.Infof("准备连接 broker ...")
 	for {
+		bt.state.transit(StateDialing, nil, nil)
 		conn, addr, err := bt.dialer.iterDial(bt.ctx, timeout)
 		if err != nil {
-			du := bt.waitN(start)
+			du := bt.backoff.Next()
 			bt.slog.Warnf("连接 broker(%s) 发生错误: %s, %s 后重试", addr, err, du)
+			bt.state.transit(StateBackoff, addr, err)
 			if err = bt.parkN(du); err != nil {
 				return err
 			}
 			continue
 		}
+		start := time.Now()
 		issue, err := bt.handshake2(conn, addr, timeout)
 		if err == nil {
+			cfg := bt.mux // 复制一份，每个会话的密钥不同
+			cfg.Passwd = issue.Passwd
+			bt.mutex.Lock()
+			if exx := bt.parent.Err(); exx != nil { // 握手期间调用了 Shutdown/Close
+				bt.mutex.Unlock()
+				_ = conn.Close()
+				return exx
+			}
 			bt.issue, bt.brkAddr = issue, addr
 			bt.laddr, bt.raddr = conn.LocalAddr(), conn.RemoteAddr()
-			cfg := smux.DefaultConfig()
-			cfg.Passwd = issue.Passwd
-			bt.muxer = smux.Client(conn, cfg)
+			bt.seq++
+			bt.muxer = smux.Client(conn, &cfg)
+			select {
+			case <-bt.ready:
+			default:
+				close(bt.ready)
+			}
+			bt.mutex.Unlock()
+			bt.flushIdle()
+			bt.dialer.report(addr, time.Since(start), nil)
 			bt.slog.Infof("连接 broker(%s) 成功", addr)
+			bt.state.transit(StateConnected, addr, nil)
 			return nil
 		}
 
-		_ = conn.Close()                                                    // 握手协商失败就关闭连接
+		_ = conn.Close() // 握手协商失败就关闭连接
+		if bt.parent.Err() == nil {
+			bt.dialer.report(addr, time.Since(start), err)
+		}
 		if exx, ok := err.(*netutil.HTTPError); ok && exx.NotAcceptable() { // NotAcceptable 代表节点已被删除
 			return exx
 		}
 
-		du := bt.waitN(start)
+		du := bt.backoff.Next()
 		bt.slog.Warnf("与 broker(%s) 发生错误: %s, %s 后重试", addr, err, du)
+		bt.state.transit(StateBackoff, addr, err)
 		if err = bt.parkN(du); err != nil {
 			return err
 		}
@@ -320,6 +555,7 @@ func (bt *borerTunnel) handshake2(conn net.Conn, addr *Address, timeout time.Dur
 			bt.slog.Warnf("重新生成机器码一致")
 		} else {
 			bt.slog.Infof("生成了新的机器码")
+			bt.ident.MachineID = machineID
 		}
 	}
 
@@ -333,6 +569,7 @@ func (bt *borerTunnel) handshake(conn net.Conn, addr *Address, timeout time.Dura
 	bt.ident.Inet = inet
 	bt.ident.MAC = mac.String()
 	bt.ident.TimeAt = time.Now()
+	bt.ident.Interval = bt.heart.handshake() // 运行期间心跳间隔可能被调整
 
 	var issue Issue
 	enc, err := bt.ident.encrypt()
@@ -343,6 +580,10 @@ func (bt *borerTunnel) handshake(conn net.Conn, addr *Address, timeout time.Dura
 	ctx, cancel := context.WithTimeout(bt.parent, timeout)
 	defer cancel()
 
+	// 防止 broker 接受了连接却迟迟不响应导致握手一直阻塞。
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
 	body := bytes.NewReader(enc)
 	req, err := bt.client.NewRequest(ctx, http.MethodConnect, "/api/v1/minion", body, nil)
 	if err != nil {
@@ -354,7 +595,8 @@ func (bt *borerTunnel) handshake(conn net.Conn, addr *Address, timeout time.Dura
 		return issue, err
 	}
 
-	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	// 握手成功后 broker 可能立即在连接上发送 smux 数据帧，不能被带缓冲的 reader 多读走。
+	res, err := http.ReadResponse(bufio.NewReader(&byteReader{r: conn}), req)
 	if err != nil {
 		return issue, err
 	}
@@ -392,29 +634,6 @@ func (*borerTunnel) localInet(addr net.Addr) net.IP {
 	}
 }
 
-// waitN 计算下次客户端重试等待间隔。
-//
-// 时长：0  3min 10min 30min        1h         12h                      ∞
-// 图例：└──┴────┴───────┴──────────┴───────────┴───────────────────────┘
-// 结果： 3s  10s   30s      1min        5min              10min
-func (*borerTunnel) waitN(start time.Time) time.Duration {
-	interval := time.Since(start)
-	switch {
-	case interval < 3*time.Minute:
-		return 3 * time.Second
-	case interval < 10*time.Minute:
-		return 10 * time.Second
-	case interval < 30*time.Minute:
-		return 30 * time.Second
-	case interval < time.Hour:
-		return time.Minute
-	case interval < 12*time.Hour:
-		return 5 * time.Minute
-	default:
-		return 10 * time.Minute
-	}
-}
-
 // parkN 协程休眠
 func (bt *borerTunnel) parkN(du time.Duration) error {
 	timer := time.NewTimer(du)
@@ -428,19 +647,48 @@ func (bt *borerTunnel) parkN(du time.Duration) error {
 	}
 }
 
-func (bt *borerTunnel) serveHTTP(srv Server) {
+// serve 运行处理 broker 请求的 Server，Server 只会启动一次，重连不影响监听器。
+func (bt *borerTunnel) serve(ln net.Listener) {
+	err := bt.srv.Serve(ln)
+	if bt.parent.Err() == nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, http.ErrServerClosed) {
+		bt.slog.Warnf("Server 异常退出：%v", err)
+	}
+}
+
+// guard 接收 broker 发起的流，并在连接断开后重连。
+func (bt *borerTunnel) guard() {
+	defer close(bt.done)
+
 	ntf := bt.ntf
 	gap := 5 * time.Second
 
-	bt.ntf.Connected(bt.brkAddr)
+	bt.notify(func() { ntf.Connected(bt.BrkAddr()) })
 
 	var err error
 	for {
 		before := time.Now()
-		ln := bt.muxer
-		err = srv.Serve(ln) // 如果连接正常则会阻塞在此
+		bt.mutex.Lock()
+		sp := newSessionPump(bt.muxer, bt.hub, bt.seq, bt.brkAddr)
+		bt.pump = sp
+		bt.mutex.Unlock()
+		if bt.parent.Err() != nil {
+			return // 调用了 Shutdown/Close，由其负责后续的关闭流程与通知
+		}
+
+		err = sp.cause() // 如果连接正常则会阻塞在此
+		if bt.parent.Err() != nil {
+			return
+		}
+		_ = bt.session().Close()
+		bt.flushIdle()
 		bt.slog.Warnf("连接断开：%s", err)
-		ntf.Disconnect(err) // 断开连接通知回调
+		bt.state.transit(StateDisconnected, bt.BrkAddr(), err)
+		bt.notify(func() { ntf.Disconnect(err) }) // 断开连接通知回调
+
+		// 连接稳定保持了一段时间才重置退避策略，防止链路抖动时频繁重连。
+		if time.Since(before) >= bt.stable {
+			bt.backoff.Reset()
+		}
 
 		// 防止出现连接成功立马断开的情况，如果连接成功立马断开，间隔过短就歇一会再试。
 		if du := gap - time.Since(before); du > time.Second {
@@ -457,10 +705,163 @@ func (bt *borerTunnel) serveHTTP(srv Server) {
 			break
 		}
 		bt.slog.Infof("重连成功")
-		addr := bt.brkAddr
-		ntf.Reconnected(addr) // 重连成功通知回调
+		addr := bt.BrkAddr()
+		bt.notify(func() { ntf.Reconnected(addr) }) // 重连成功通知回调
+		go bt.replay()
+	}
+	if bt.parent.Err() != nil {
+		return
 	}
 
 	bt.slog.Warnf("连接已经断开不再重连：%s", err)
-	ntf.Shutdown(err)
+	bt.notifyShutdown(err)
+}
+
+// Forward TCP 端口转发
+func (bt *borerTunnel) Forward(ctx context.Context, localAddr, remoteAddr string) error {
+	spec := ForwardSpec{Network: "tcp", Local: localAddr, Remote: remoteAddr}
+	return NewForwarder(bt, spec).Run(ctx)
+}
+
+// Outbox 离线上报队列
+func (bt *borerTunnel) Outbox() *Outbox {
+	return bt.outbox
+}
+
+// Heartbeat 心跳控制器
+func (bt *borerTunnel) Heartbeat() *Heartbeat {
+	return bt.heart
+}
+
+// Services 本地服务注册表
+func (bt *borerTunnel) Services() *ServiceRegistry {
+	return bt.services
+}
+
+// Listener broker 发起的流的监听器
+func (bt *borerTunnel) Listener() net.Listener {
+	bt.lnOnce.Do(func() {
+		bt.userLn = bt.hub.listen()
+		if bt.fallback != nil {
+			_ = bt.fallback.Close() // 不再由默认的 404 Server 处理
+		}
+	})
+
+	return bt.userLn
+}
+
+func (bt *borerTunnel) Shutdown(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return bt.shutdown(ctx, true, ErrTunnelClosed)
+}
+
+// Close 立即关闭通道，不等待未完成的流。
+func (bt *borerTunnel) Close() error {
+	return bt.shutdown(context.Background(), false, ErrTunnelClosed)
+}
+
+// shutdown 关闭通道，cause 为通知 Notifier.Shutdown 的原因。
+func (bt *borerTunnel) shutdown(ctx context.Context, graceful bool, cause error) error {
+	bt.quit() // 停止重连与心跳
+
+	bt.mutex.RLock()
+	sp := bt.pump
+	bt.mutex.RUnlock()
+	if sp != nil {
+		_ = sp.Close() // 不再接收新的流
+	}
+	bt.hub.close()
+
+	var err error
+	if graceful {
+		err = shutdownServer(ctx, bt.srv)
+		bt.flushIdle()
+		if exx := bt.drain(ctx); err == nil {
+			err = exx
+		}
+	} else if c, ok := bt.srv.(interface{ Close() error }); ok {
+		_ = c.Close()
+	}
+
+	if sess := bt.session(); sess != nil {
+		_ = sess.Close()
+	}
+	bt.flushIdle()
+
+	// 在 Notifier 回调中调用 Close/Shutdown 时，guard 协程正阻塞在该回调上，
+	// 等待其退出会导致死锁。此时 quit 之后 guard 在回调返回后会自行退出。
+	if bt.notifies.Load() == 0 {
+		select {
+		case <-bt.done:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+	if bt.outbox != nil {
+		_ = bt.outbox.Close()
+	}
+	bt.notifyShutdown(cause)
+
+	return err
+}
+
+// shutdownServer 如果 Server 支持优雅关闭则调用之。
+func shutdownServer(ctx context.Context, srv Server) error {
+	switch srv := srv.(type) {
+	case interface{ Shutdown(context.Context) error }: // net/http
+		return srv.Shutdown(ctx)
+	case interface{ Shutdown() error }: // fasthttp
+		errc := make(chan error, 1)
+		go func() { errc <- srv.Shutdown() }()
+		select {
+		case err := <-errc:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	default:
+		return nil
+	}
+}
+
+// drain 等待当前会话上的流全部关闭。
+func (bt *borerTunnel) drain(ctx context.Context) error {
+	sess := bt.session()
+	if sess == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for sess.NumStreams() != 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// notifyShutdown 通道关闭通知，保证只通知一次。
+// 不使用 sync.Once：Notifier.Shutdown 中再次调用 Close 时 Once.Do 会死锁。
+func (bt *borerTunnel) notifyShutdown(err error) {
+	if !bt.notified.CompareAndSwap(false, true) {
+		return
+	}
+	bt.hub.close()
+	bt.state.transit(StateShutdown, nil, err)
+	bt.notify(func() { bt.ntf.Shutdown(err) })
+}
+
+// notify 调用 Notifier 回调，回调中可以调用 Close/Shutdown。
+func (bt *borerTunnel) notify(fn func()) {
+	bt.notifies.Add(1)
+	defer bt.notifies.Add(-1)
+	fn()
 }
@@ -0,0 +1,91 @@
+package brokerapi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// TagRequest 修改节点标签。只可以新增不存在的标签，只可以删除 agent 自己新增的标签，
+// Add 与 Del 都不能超过 50 个。
+type TagRequest struct {
+	Add []string `json:"add"`
+	Del []string `json:"del"`
+}
+
+// Event 事件。
+type Event struct {
+	Subject    string    `json:"subject"`     // 主题
+	RemoteAddr string    `json:"remote_addr"` // 远程地址
+	RemotePort int       `json:"remote_port"` // 远程端口
+	FromCode   string    `json:"from_code"`   // 来源模块
+	Typeof     string    `json:"typeof"`      // 模块类型
+	User       string    `json:"user"`        // 用户信息
+	Auth       string    `json:"auth"`        // 认证信息
+	Msg        string    `json:"msg"`         // 上报消息
+	Error      string    `json:"error"`       // 错误信息
+	Region     string    `json:"region"`      // IP 定位
+	Level      string    `json:"level"`       // 告警级别 紧急 重要 次要 普通
+	SendAlert  bool      `json:"send_alert"`  // 是否需要发送告警
+	OccurAt    time.Time `json:"occur_at"`    // 事件发生的时间
+	CreatedAt  time.Time `json:"created_at"`  // 创建时间
+}
+
+// Risk 风险事件。
+type Risk struct {
+	// Class 风险类型
+	// ["暴力破解", "病毒事件", "弱口令", "数据爬虫", "蜜罐应用", "web 攻击", "监控事件", "登录事件"]
+	Class      string    `json:"class"`
+	Inet       string    `json:"inet"`        // 节点 IPv4
+	Level      string    `json:"level"`       // 风险级别 紧急 高危 中危 低危
+	Payload    string    `json:"payload"`     // 攻击载荷
+	Subject    string    `json:"subject"`     // 风险事件主题
+	LocalIP    string    `json:"local_ip"`    // 本地 IP
+	LocalPort  int       `json:"local_port"`  // 本地端口
+	RemoteIP   string    `json:"remote_ip"`   // 远程 IP
+	RemotePort int       `json:"remote_port"` // 远程端口
+	FromCode   string    `json:"from_code"`   // 来源模块
+	Region     string    `json:"region"`      // IP 归属地
+	Reference  string    `json:"reference"`   // 参考引用
+	Alert      bool      `json:"alert"`       // 是否需要发送告警
+	Time       time.Time `json:"time"`        // 风险产生的时间
+}
+
+// OperateTag 新增或删除节点标签。
+//
+// POST /api/v1/broker/operate/tag
+func (c *Client) OperateTag(ctx context.Context, req *TagRequest) error {
+	tag := *req // 两个字段都是必填的，nil 会被编码为 null
+	if tag.Add == nil {
+		tag.Add = []string{}
+	}
+	if tag.Del == nil {
+		tag.Del = []string{}
+	}
+
+	return c.postJSON(ctx, "/broker/operate/tag", &tag)
+}
+
+// AuditEvent 上报事件。
+//
+// POST /api/v1/broker/audit/event
+func (c *Client) AuditEvent(ctx context.Context, req *Event) error {
+	return c.postJSON(ctx, "/broker/audit/event", req)
+}
+
+// AuditRisk 上报风险事件。
+//
+// POST /api/v1/broker/audit/risk
+func (c *Client) AuditRisk(ctx context.Context, req *Risk) error {
+	return c.postJSON(ctx, "/broker/audit/risk", req)
+}
+
+// ForwardElastic 将 elastic bulk 报文（NDJSON）转发至 broker 配置的 ES，
+// 目前仅支持 bulk 操作。
+//
+// POST /api/v1/broker/forward/elastic
+func (c *Client) ForwardElastic(ctx context.Context, bulk io.Reader) error {
+	header := http.Header{"Content-Type": []string{"application/x-ndjson"}}
+	return c.post(ctx, "/broker/forward/elastic", bulk, header)
+}
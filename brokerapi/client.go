@@ -0,0 +1,124 @@
+// Package brokerapi 是 broker 节点接口（见 docs/api.yaml）的类型化客户端，
+// 所有请求都经由 tunnel.Tunneler 的通道发送。
+//
+//	cli := brokerapi.New(tun)
+//	err := cli.OperateTag(ctx, &brokerapi.TagRequest{Add: []string{"centos7"}})
+package brokerapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+// Client broker 接口客户端，可以并发使用。
+type Client struct {
+	cli netutil.HTTPClient
+}
+
+// New 创建基于通道的 broker 接口客户端，底层使用 tun.HTTPClient，
+// 会话断开重连后会自动丢弃失效的连接。
+func New(tun tunnel.Tunneler) *Client {
+	return NewWithHTTPClient(tun.HTTPClient())
+}
+
+// NewWithHTTPClient 使用自定义的 http.Client 创建客户端，cli 必须能够将请求发往 broker，
+// 例如 Transport 的 DialContext 为 tun.DialContext。
+func NewWithHTTPClient(cli *http.Client) *Client {
+	trip := cli.Transport
+	if trip == nil {
+		trip = http.DefaultTransport
+	}
+
+	return &Client{cli: netutil.NewClient(trip)}
+}
+
+// Error broker 响应的错误。
+type Error struct {
+	Code    int    // HTTP 状态码
+	Message string // 错误信息，broker 响应 JSON 时取其中的 message 字段，否则为响应报文
+	Body    []byte // 原始响应报文，最多 1024 字节
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("broker 响应错误，状态码：%d", e.Code)
+	}
+	return fmt.Sprintf("broker 响应错误，状态码：%d，%s", e.Code, e.Message)
+}
+
+// Is 状态码相同即认为是同一个错误，可以用 errors.Is(err, brokerapi.ErrNotFound) 判断。
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	// ErrNotModified 文件未发生变化或者没有可用的更新。
+	ErrNotModified = &Error{Code: http.StatusNotModified}
+
+	// ErrBadRequest 请求参数错误。
+	ErrBadRequest = &Error{Code: http.StatusBadRequest}
+
+	// ErrNotFound 资源不存在。
+	ErrNotFound = &Error{Code: http.StatusNotFound}
+)
+
+// decodeError 将 netutil.HTTPError 转为 *Error，其它错误原样返回。
+func decodeError(err error) error {
+	var he *netutil.HTTPError
+	if !errors.As(err, &he) {
+		return err
+	}
+
+	e := &Error{Code: he.Code, Body: he.Body}
+	var msg struct {
+		Message string `json:"message"`
+		Msg     string `json:"msg"`
+	}
+	if json.Unmarshal(he.Body, &msg) == nil {
+		e.Message = msg.Message
+		if e.Message == "" {
+			e.Message = msg.Msg
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(he.Body))
+	}
+
+	return e
+}
+
+// postJSON 发送 JSON 报文，不关心响应。
+func (c *Client) postJSON(ctx context.Context, path string, body any) error {
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(body); err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+
+	return c.post(ctx, path, buf, header)
+}
+
+func (c *Client) post(ctx context.Context, path string, body io.Reader, header http.Header) error {
+	res, err := c.cli.Fetch(ctx, http.MethodPost, brokerURL(path), body, header)
+	if err != nil {
+		return decodeError(err)
+	}
+	_, _ = io.Copy(io.Discard, res.Body)
+
+	return res.Body.Close()
+}
+
+// brokerURL 构造请求地址，通道会忽略地址中的 Host。
+func brokerURL(path string) string {
+	return "http://soc/api/v1" + path
+}
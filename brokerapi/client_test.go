@@ -0,0 +1,74 @@
+package brokerapi_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/vela-ssoc/vela-tunnel"
+	"github.com/vela-ssoc/vela-tunnel/brokerapi"
+	"github.com/vela-ssoc/vela-tunnel/tunneltest"
+)
+
+type machineID struct{}
+
+func (machineID) MachineID(bool) string { return "brokerapi" }
+
+func TestClient(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("POST /api/v1/broker/operate/tag", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"add":["centos7"],"del":[]}`+"\n" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"标签格式错误"}`))
+		}
+	})
+	h.HandleFunc("GET /api/v1/broker/third", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("hash") {
+		case "same":
+			w.WriteHeader(http.StatusNotModified)
+		case "":
+			w.Header().Set("Content-Disposition", `attachment; filename="ip2region.db"; id="12"; hash="abc"`)
+			_, _ = w.Write([]byte("hello"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	brk := tunneltest.NewBroker(h)
+	defer brk.Close()
+
+	ctx := context.Background()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(machineID{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	cli := brokerapi.New(tun)
+
+	if err = cli.OperateTag(ctx, &brokerapi.TagRequest{Add: []string{"centos7"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = cli.OperateTag(ctx, &brokerapi.TagRequest{Add: []string{"x"}})
+	var e *brokerapi.Error
+	if !errors.As(err, &e) || !errors.Is(err, brokerapi.ErrBadRequest) || e.Message != "标签格式错误" {
+		t.Fatalf("期望 400 错误，实际：%v", err)
+	}
+
+	d, err := cli.Third(ctx, brokerapi.ThirdRequest{Name: "ip2region.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(d)
+	_ = d.Close()
+	if info := d.ThirdInfo(); string(body) != "hello" || d.Filename != "ip2region.db" || info.ID != 12 || info.MD5 != "abc" {
+		t.Fatalf("下载错误：%q %+v", body, d)
+	}
+	if _, err = cli.Third(ctx, brokerapi.ThirdRequest{Name: "ip2region.db", Hash: "same"}); !errors.Is(err, brokerapi.ErrNotModified) {
+		t.Fatalf("期望 ErrNotModified，实际：%v", err)
+	}
+	if _, err = cli.Third(ctx, brokerapi.ThirdRequest{Name: "ip2region.db", Hash: "other"}); !errors.Is(err, brokerapi.ErrNotFound) {
+		t.Fatalf("期望 ErrNotFound，实际：%v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package brokerapi
+
+import (
+	"context"
+	"time"
+)
+
+// Sysinfo 系统信息。
+type Sysinfo struct {
+	HostID      string `json:"host_id"`
+	Hostname    string `json:"hostname"`
+	Release     string `json:"release"`
+	Family      string `json:"family"`
+	Uptime      int64  `json:"uptime"`
+	BootAt      int64  `json:"boot_at"`
+	Virtual     string `json:"virtual"`
+	VirtualRole string `json:"virtual_role"`
+	ProcNumber  int    `json:"proc_number"`
+	MemTotal    int    `json:"mem_total"`
+	MemFree     int    `json:"mem_free"`
+	SwapTotal   int    `json:"swap_total"`
+	SwapFree    int    `json:"swap_free"`
+	CPUCore     int    `json:"cpu_core"`
+	CPUModel    string `json:"cpu_model"`
+	AgentTotal  int    `json:"agent_total"`
+	AgentAlloc  int    `json:"agent_alloc"`
+	Version     string `json:"version"`
+}
+
+// ProcessDiff 进程变化。
+type ProcessDiff struct {
+	Creates []*Process `json:"creates"` // 新增的进程
+	Updates []*Process `json:"updates"` // 更新的进程
+	Deletes []int      `json:"deletes"` // 删除的 PID
+}
+
+// Process 进程信息。
+type Process struct {
+	Name         string    `json:"name"`
+	State        string    `json:"state"`
+	Pid          int       `json:"pid"`
+	Ppid         int       `json:"ppid"`
+	Pgid         uint32    `json:"pgid"`
+	Cmdline      string    `json:"cmdline"`
+	Username     string    `json:"username"`
+	Cwd          string    `json:"cwd"`
+	Executable   string    `json:"executable"` // linux
+	Args         []string  `json:"args"`
+	UserTicks    uint64    `json:"user_ticks"`
+	TotalPct     float64   `json:"total_pct"`
+	TotalNormPct float64   `json:"total_norm_pct"`
+	SystemTicks  uint64    `json:"system_ticks"`
+	TotalTicks   uint64    `json:"total_ticks"`
+	StartTime    string    `json:"start_time"`
+	MemSize      uint64    `json:"mem_size"`
+	RssBytes     uint64    `json:"rss_bytes"`
+	RssPct       float64   `json:"rss_pct"`
+	Share        uint64    `json:"share"`
+	Checksum     string    `json:"checksum"`
+	ModifyTime   time.Time `json:"modify_time"`
+	CreateTime   time.Time `json:"create_time"`
+}
+
+// Logon 登录信息。
+type Logon struct {
+	User    string    `json:"user"`
+	Addr    string    `json:"addr"`
+	Class   string    `json:"class"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	PID     int       `json:"pid"`
+	Device  string    `json:"device"`
+	Process string    `json:"process"`
+}
+
+// ListenDiff 端口监听变化。
+type ListenDiff struct {
+	Creates []*Listen `json:"creates"` // 新增的 Listen
+	Updates []*Listen `json:"updates"` // 更新的 Listen
+	Deletes []string  `json:"deletes"` // 删除的 Listen RecordID
+}
+
+// Listen 端口监听信息。
+type Listen struct {
+	RecordID  string `json:"record_id"`
+	PID       uint32 `json:"pid"`
+	FD        int    `json:"fd"`
+	Family    uint8  `json:"family"`
+	Protocol  uint8  `json:"protocol"`
+	LocalIP   string `json:"local_ip"`
+	LocalPort int    `json:"local_port"`
+	Path      string `json:"path"`
+	State     string `json:"state"`
+	Process   string `json:"process"`
+	Username  string `json:"username"`
+}
+
+// AccountDiff 账户变化。
+type AccountDiff struct {
+	Creates []*Account `json:"creates"` // 新增的账户
+	Updates []*Account `json:"updates"` // 更新的账户
+	Deletes []string   `json:"deletes"` // 删除的账户名
+}
+
+// Account 账户信息。
+type Account struct {
+	Name        string `json:"name"`
+	LoginName   string `json:"login_name"`
+	UID         string `json:"uid"`
+	GID         string `json:"gid"`
+	HomeDir     string `json:"home_dir"`
+	Description string `json:"description"`
+	Status      string `json:"status"`
+	Raw         string `json:"raw"`
+}
+
+// GroupDiff 用户组变化。
+type GroupDiff struct {
+	Creates []*Group `json:"creates"` // 新增的用户组
+	Updates []*Group `json:"updates"` // 更新的用户组
+	Deletes []string `json:"deletes"` // 删除的用户组名
+}
+
+// Group 用户组信息。
+type Group struct {
+	Name        string `json:"name"`
+	GID         string `json:"gid"`
+	Description string `json:"description"`
+}
+
+// SBOM 软件供应链信息。
+type SBOM struct {
+	Filename  string       `json:"filename"`
+	Algorithm string       `json:"algorithm"`
+	Checksum  string       `json:"checksum"`
+	ModifyAt  time.Time    `json:"modify_time"`
+	Size      int64        `json:"size"`
+	Process   SBOMProcess  `json:"process"`
+	Packages  []*SBOMEntry `json:"packages"`
+}
+
+// SBOMEntry 软件包信息。
+type SBOMEntry struct {
+	Purl      string   `json:"purl"`
+	Name      string   `json:"name"`
+	Version   string   `json:"version"`
+	Language  string   `json:"language"`
+	Algorithm string   `json:"algorithm"`
+	Checksum  string   `json:"checksum"`
+	Licenses  []string `json:"licenses"`
+}
+
+// SBOMProcess 使用该文件的进程。
+type SBOMProcess struct {
+	PID      int    `json:"pid"`
+	Exe      string `json:"exe"`
+	Username string `json:"username"`
+}
+
+// CollectSysinfo 上报系统信息。
+//
+// POST /api/v1/broker/collect/agent/sysinfo
+func (c *Client) CollectSysinfo(ctx context.Context, req *Sysinfo) error {
+	return c.postJSON(ctx, "/broker/collect/agent/sysinfo", req)
+}
+
+// CollectProcess 上报进程信息。
+//
+// POST /api/v1/broker/collect/agent/process
+func (c *Client) CollectProcess(ctx context.Context, req *ProcessDiff) error {
+	return c.postJSON(ctx, "/broker/collect/agent/process", req)
+}
+
+// CollectLogon 上报登录信息。
+//
+// POST /api/v1/broker/collect/agent/logon
+func (c *Client) CollectLogon(ctx context.Context, req *Logon) error {
+	return c.postJSON(ctx, "/broker/collect/agent/logon", req)
+}
+
+// CollectListen 上报端口监听信息。
+//
+// POST /api/v1/broker/collect/agent/listen
+func (c *Client) CollectListen(ctx context.Context, req *ListenDiff) error {
+	return c.postJSON(ctx, "/broker/collect/agent/listen", req)
+}
+
+// CollectAccount 上报账户信息。
+//
+// POST /api/v1/broker/collect/agent/account
+func (c *Client) CollectAccount(ctx context.Context, req *AccountDiff) error {
+	return c.postJSON(ctx, "/broker/collect/agent/account", req)
+}
+
+// CollectGroup 上报用户组信息。
+//
+// POST /api/v1/broker/collect/agent/group
+func (c *Client) CollectGroup(ctx context.Context, req *GroupDiff) error {
+	return c.postJSON(ctx, "/broker/collect/agent/group", req)
+}
+
+// CollectSBOM 上报软件供应链信息。
+//
+// POST /api/v1/broker/collect/agent/sbom
+func (c *Client) CollectSBOM(ctx context.Context, req *SBOM) error {
+	return c.postJSON(ctx, "/broker/collect/agent/sbom", req)
+}
@@ -0,0 +1,104 @@
+package brokerapi
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ThirdRequest 下载三方文件的参数。
+type ThirdRequest struct {
+	Name string // 三方文件名字，必填
+	Hash string // 本地已有文件的 MD5，文件未改变时返回 ErrNotModified
+}
+
+// UpgradeRequest 检查更新的参数。
+type UpgradeRequest struct {
+	Version string   // 要升级到的版本，为空代表升级到最新版
+	Tags    []string // 隐写在二进制文件中的标签，元素不可重复，不能多于 16 个
+}
+
+// Download 下载的文件，使用完毕后必须调用 Close。
+type Download struct {
+	Filename     string            // 文件名
+	Size         int64             // 文件大小，未知时为 -1
+	Dispositions map[string]string // Content-Disposition 中的全部参数
+	body         io.ReadCloser
+}
+
+func (d *Download) Read(p []byte) (int, error) {
+	return d.body.Read(p)
+}
+
+func (d *Download) Close() error {
+	return d.body.Close()
+}
+
+// ThirdInfo 三方文件的信息。
+type ThirdInfo struct {
+	ID         int64  // 三方文件 ID
+	MD5        string // MD5
+	Desc       string // 说明
+	Customized string // 分类
+	Extension  string // 扩展名
+}
+
+// ThirdInfo 从 Content-Disposition 中解析三方文件的信息。
+func (d *Download) ThirdInfo() ThirdInfo {
+	dis := d.Dispositions
+	id, _ := strconv.ParseInt(dis["id"], 10, 64)
+
+	return ThirdInfo{
+		ID:         id,
+		MD5:        dis["hash"],
+		Desc:       dis["desc"],
+		Customized: dis["customized"],
+		Extension:  dis["extension"],
+	}
+}
+
+// Third 下载三方文件，文件未改变时返回 ErrNotModified，文件不存在时返回 ErrNotFound。
+//
+// GET /api/v1/broker/third
+func (c *Client) Third(ctx context.Context, req ThirdRequest) (*Download, error) {
+	q := url.Values{"name": []string{req.Name}}
+	if req.Hash != "" {
+		q.Set("hash", req.Hash)
+	}
+
+	return c.download(ctx, "/broker/third?"+q.Encode())
+}
+
+// UpgradeDownload 检查更新并下载新版本，没有可用的更新时返回 ErrNotModified。
+//
+// GET /api/v1/broker/upgrade/download
+func (c *Client) UpgradeDownload(ctx context.Context, req UpgradeRequest) (*Download, error) {
+	q := url.Values{"tags": req.Tags}
+	if req.Version != "" {
+		q.Set("version", req.Version)
+	}
+
+	return c.download(ctx, "/broker/upgrade/download?"+q.Encode())
+}
+
+func (c *Client) download(ctx context.Context, path string) (*Download, error) {
+	res, err := c.cli.Fetch(ctx, http.MethodGet, brokerURL(path), nil, nil)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	if code := res.StatusCode; code == http.StatusNotModified || code == http.StatusNoContent {
+		_ = res.Body.Close()
+		return nil, ErrNotModified
+	}
+
+	d := &Download{Size: res.ContentLength, Dispositions: map[string]string{}, body: res.Body}
+	if _, params, _ := mime.ParseMediaType(res.Header.Get("Content-Disposition")); params != nil {
+		d.Dispositions = params
+		d.Filename = params["filename"]
+	}
+
+	return d, nil
+}
@@ -3,6 +3,7 @@ package tunnel
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/url"
 	"strings"
@@ -11,47 +12,145 @@ import (
 
 type dialer interface {
 	iterDial(context.Context, time.Duration) (net.Conn, *Address, error)
+	report(*Address, time.Duration, error)
 	lookupMAC(net.IP) net.HardwareAddr
 }
 
-func newDialer(addrs []string, servername string) dialer {
+// newDialer 创建连接器，开启了 WithHappyEyeballs 时创建并行竞速连接器。
+func newDialer(addrs []string, servername string, opt *option) dialer {
 	dl := &iterDial{
-		dial: &tls.Dialer{NetDialer: new(net.Dialer)},
-		macs: make(map[string]net.HardwareAddr, 4),
+		dial:     &tls.Dialer{NetDialer: new(net.Dialer)},
+		macs:     make(map[string]net.HardwareAddr, 4),
+		tlsOf:    make(map[*Address]*Address, len(addrs)),
+		selector: opt.selector,
+		tls:      &opt.tls,
+		proxy:    opt.proxy,
+	}
+	dl.addrs = dl.toAddrs(addrs, servername, opt.tlsOnly)
+	if opt.race > 0 {
+		return &raceDial{base: dl, delay: opt.race, resolver: net.DefaultResolver, slog: opt.slog}
 	}
-
-	ads := dl.toAddrs(addrs, servername)
-	dl.addrs = ads
-	dl.length = len(ads)
 
 	return dl
 }
 
 type iterDial struct {
-	dial   *tls.Dialer
-	macs   map[string]net.HardwareAddr
-	addrs  Addresses
-	length int
-	index  int
+	dial     *tls.Dialer
+	macs     map[string]net.HardwareAddr
+	addrs    Addresses
+	tlsOf    map[*Address]*Address // 明文地址 -> 同一主机的 TLS 地址，明文连接只能在 TLS 连接失败后发起
+	selector Selector
+	tls      *tlsPolicies
+	proxy    ProxyFunc
 }
 
 func (dl *iterDial) iterDial(parent context.Context, timeout time.Duration) (net.Conn, *Address, error) {
-	idx := dl.index
-	addr := dl.addrs[idx]
-	dl.index = (idx + 1) % dl.length
+	addr := dl.selectAddr(parent)
 
 	ctx, cancel := context.WithTimeout(parent, timeout)
 	defer cancel()
 
-	if addr.TLS {
-		dial := dl.dial
-		dial.Config = &tls.Config{ServerName: addr.Name}
-		conn, err := dial.DialContext(ctx, "tcp", addr.Addr)
-		return conn, addr, err
+	proxy, err := dl.proxyFor(addr)
+	if err != nil {
+		return nil, addr, err
+	}
+
+	start := time.Now()
+	conn, err := dl.dialAddr(ctx, addr, addr.Addr, proxy)
+	if parent.Err() == nil { // 主动取消的连接不计入连接结果
+		dl.selector.Report(addr, time.Since(start), err)
+	}
+
+	return conn, via(addr, proxy), err
+}
+
+// selectAddr 选择要连接的地址，需要探测的选择策略会使用 ctx 与经过代理的探测函数。
+func (dl *iterDial) selectAddr(ctx context.Context) *Address {
+	if ps, ok := dl.selector.(probeSelector); ok {
+		return ps.selectProbe(ctx, dl.addrs, dl.probe)
+	}
+
+	return dl.selector.Select(dl.addrs)
+}
+
+// probe 建立到 addr 的 TCP 连接，不进行 TLS 握手，配置了代理时经过代理连接。
+func (dl *iterDial) probe(ctx context.Context, addr *Address) (net.Conn, error) {
+	proxy, err := dl.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		return proxyDial(ctx, dl.dial.NetDialer, proxy, addr.Addr)
+	}
+
+	return dl.dial.NetDialer.DialContext(ctx, "tcp", addr.Addr)
+}
+
+// report 向 Selector 反馈握手结果，addr 可能是 via 返回的副本，
+// 需要找回原始地址作为 Selector 的地址标识。
+//
+// 连接成功时已经上报过，握手成功后不再重复调用 Report，只通知 handshakeReporter。
+func (dl *iterDial) report(addr *Address, rtt time.Duration, err error) {
+	for _, a := range dl.addrs {
+		if a.TLS == addr.TLS && a.Addr == addr.Addr {
+			if err != nil {
+				dl.selector.Report(a, rtt, err)
+			}
+			if hr, ok := dl.selector.(handshakeReporter); ok {
+				hr.handshaked(a, err)
+			}
+			return
+		}
+	}
+}
+
+// dialAddr 连接 addr，hostport 为实际要连接的地址，一般就是 addr.Addr，
+// 也可以是 addr.Addr 解析后的某个 IP 地址。proxy 不为 nil 时经过代理连接。
+// 开启 TLS 时会完成 TLS 握手。
+func (dl *iterDial) dialAddr(ctx context.Context, addr *Address, hostport string, proxy *url.URL) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = proxyDial(ctx, dl.dial.NetDialer, proxy, hostport)
 	} else {
-		conn, err := dl.dial.NetDialer.DialContext(ctx, "tcp", addr.Addr)
-		return conn, addr, err
+		conn, err = dl.dial.NetDialer.DialContext(ctx, "tcp", hostport)
 	}
+	if err != nil || !addr.TLS {
+		return conn, err
+	}
+
+	tc := tls.Client(conn, dl.tls.config(addr))
+	if err = tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// proxyFor 连接 addr 所使用的代理，nil 代表直连。
+func (dl *iterDial) proxyFor(addr *Address) (*url.URL, error) {
+	if dl.proxy == nil {
+		return nil, nil
+	}
+	proxy, err := dl.proxy(addr)
+	if err != nil {
+		return nil, fmt.Errorf("获取代理配置错误：%w", err)
+	}
+
+	return proxy, nil
+}
+
+// via 返回带有代理信息的地址副本，用于日志输出与上报。
+// 不能直接修改 addr，它还会作为 Selector 的地址标识。
+func via(addr *Address, proxy *url.URL) *Address {
+	if proxy == nil {
+		return addr
+	}
+	cp := *addr
+	cp.Proxy = proxy.Redacted()
+
+	return &cp
 }
 
 func (dl *iterDial) lookupMAC(ip net.IP) net.HardwareAddr {
@@ -82,11 +181,12 @@ func (dl *iterDial) lookupMAC(ip net.IP) net.HardwareAddr {
 	return mac
 }
 
-func (dl *iterDial) toAddrs(addrs []string, servername string) Addresses {
+// toAddrs 每个地址生成 TLS 与明文两种连接方式，tlsOnly 为 true 时不生成明文连接。
+func (dl *iterDial) toAddrs(addrs []string, servername string, tlsOnly bool) Addresses {
 	size := len(addrs)
 	ret := make(Addresses, 0, size)
 	tcps := make(map[string]struct{}, size)
-	ssls := make(map[string]struct{}, size)
+	ssls := make(map[string]*Address, size)
 
 	for _, addr := range addrs {
 		host, port := splitHostPort(addr)
@@ -97,13 +197,17 @@ func (dl *iterDial) toAddrs(addrs []string, servername string) Addresses {
 		shost := net.JoinHostPort(host, sport)
 		thost := net.JoinHostPort(host, tport)
 
-		if _, ok := ssls[shost]; !ok {
-			ssls[shost] = struct{}{}
-			ret = append(ret, &Address{TLS: true, Addr: shost, Name: servername})
+		sa, ok := ssls[shost]
+		if !ok {
+			sa = &Address{TLS: true, Addr: shost, Name: servername}
+			ssls[shost] = sa
+			ret = append(ret, sa)
 		}
-		if _, ok := tcps[thost]; !ok {
+		if _, ok = tcps[thost]; !ok && !tlsOnly {
+			ta := &Address{Addr: thost, Name: servername}
 			tcps[thost] = struct{}{}
-			ret = append(ret, &Address{Addr: thost, Name: servername})
+			dl.tlsOf[ta] = sa
+			ret = append(ret, ta)
 		}
 	}
 
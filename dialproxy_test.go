@@ -0,0 +1,44 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestSocks5Connect(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- socks5Connect(cli, &url.URL{Scheme: "socks5h", User: url.UserPassword("u", "p")}, "broker.example.com:443")
+	}()
+
+	buf := make([]byte, 64)
+	if _, err := io.ReadFull(srv, buf[:4]); err != nil || !bytes.Equal(buf[:4], []byte{5, 2, 0, 2}) {
+		t.Fatalf("认证方式协商错误：%v %v", buf[:4], err)
+	}
+	_, _ = srv.Write([]byte{5, 2})
+
+	want := []byte{1, 1, 'u', 1, 'p'}
+	if _, err := io.ReadFull(srv, buf[:len(want)]); err != nil || !bytes.Equal(buf[:len(want)], want) {
+		t.Fatalf("用户名密码认证错误：%v %v", buf[:len(want)], err)
+	}
+	_, _ = srv.Write([]byte{1, 0})
+
+	host := "broker.example.com"
+	want = append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	want = append(want, 0x01, 0xbb)
+	if _, err := io.ReadFull(srv, buf[:len(want)]); err != nil || !bytes.Equal(buf[:len(want)], want) {
+		t.Fatalf("连接请求错误：%v %v", buf[:len(want)], err)
+	}
+	_, _ = srv.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0x01, 0xbb})
+
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
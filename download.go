@@ -0,0 +1,363 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+)
+
+// DownloadProgress 下载进度回调，written 为已经写入的字节数，total 为文件总大小，未知时为 -1。
+type DownloadProgress func(written, total int64)
+
+// ErrChecksum 下载的文件与 broker 给出的 hash 不一致。
+var ErrChecksum = errors.New("文件校验失败")
+
+// ErrNoChecksum 通过 RequireChecksum 要求校验文件，但是 broker 的响应中没有 hash。
+var ErrNoChecksum = errors.New("broker 没有提供文件的 hash，无法校验")
+
+// DownloadOption DownloadFile 的可选参数。
+type DownloadOption func(*downloadOption)
+
+type downloadOption struct {
+	requireChecksum bool
+}
+
+// RequireChecksum 要求必须校验文件：broker 的响应中没有 hash 时，DownloadFile 会删除临时文件
+// 并返回 ErrNoChecksum，适用于升级包等未经校验不能使用的文件。
+func RequireChecksum() DownloadOption {
+	return func(opt *downloadOption) {
+		opt.requireChecksum = true
+	}
+}
+
+// downloadRetries 连续多少次没有任何进展后放弃下载。
+const downloadRetries = 5
+
+// DownloadFile 断点续传下载文件
+func (bt *borerTunnel) DownloadFile(ctx context.Context, path, dest string, progress DownloadProgress, opts ...DownloadOption) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	opt := new(downloadOption)
+	for _, fn := range opts {
+		fn(opt)
+	}
+
+	tmp := dest + ".download"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	dl := &download{tun: bt, path: path, file: file, meta: tmp + ".meta", progress: progress, total: -1}
+	if err = dl.run(ctx); err != nil {
+		var he *netutil.HTTPError
+		if errors.As(err, &he) { // 响应了非预期的状态码，不会再续传
+			dl.discard()
+		}
+		return err
+	}
+
+	if dl.hash == "" && opt.requireChecksum {
+		dl.discard()
+		return ErrNoChecksum
+	}
+	if dl.hash != "" {
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		h := md5.New()
+		if _, err = io.Copy(h, file); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, dl.hash) {
+			dl.discard()
+			return fmt.Errorf("%w：期望 %s，实际 %s", ErrChecksum, dl.hash, sum)
+		}
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dest); err != nil {
+		return err
+	}
+	_ = os.Remove(dl.meta)
+
+	return nil
+}
+
+// download 一次断点续传下载。
+type download struct {
+	tun       *borerTunnel
+	path      string
+	file      *os.File
+	meta      string // 记录 hash 和 validator 的文件，进程重启后续传时用于判断远端文件是否变化
+	progress  DownloadProgress
+	written   int64  // 已经写入的字节数
+	total     int64  // 文件总大小，未知时为 -1
+	hash      string // Content-Disposition 中的 hash 参数
+	validator string // 响应的强 ETag 或 Last-Modified，续传时作为 If-Range 保证远端文件没有变化
+}
+
+func (dl *download) run(ctx context.Context) error {
+	info, err := dl.file.Stat()
+	if err != nil {
+		return err
+	}
+	if dl.written = info.Size(); dl.written > 0 { // 上次下载遗留的临时文件
+		if !dl.restore() { // 无法判断远端文件是否变化，从头下载
+			if err = dl.truncate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	var retries int
+	for {
+		before := dl.written
+		done, err := dl.fetch(ctx)
+		if done {
+			return nil
+		}
+		if exx := ctx.Err(); exx != nil {
+			return exx
+		}
+		var he *netutil.HTTPError
+		if errors.As(err, &he) {
+			return err
+		}
+		if dl.written > before {
+			retries = 0
+		} else if retries++; retries >= downloadRetries {
+			return err
+		}
+
+		dl.tun.slog.Warnf("下载 %s 中断（已下载 %d 字节），等待通道恢复后续传：%s", dl.path, dl.written, err)
+		if err = dl.tun.awaitReady(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// fetch 从 written 处续传，下载完毕返回 true。
+//
+// 续传时携带 If-Range，远端文件变化后 broker 会响应完整的文件；broker 不支持 If-Range 时，
+// 如果响应的 hash 或 ETag 与之前的响应不一致，则认为远端文件已经变化，从头重新下载。
+func (dl *download) fetch(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.tun.httpURL(dl.path), nil)
+	if err != nil {
+		return false, err
+	}
+	if dl.written > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(dl.written, 10)+"-")
+		if dl.validator != "" {
+			req.Header.Set("If-Range", dl.validator)
+		}
+	}
+	res, err := dl.tun.httpCli.Do(req)
+	if err != nil {
+		return false, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+
+	var hash string
+	if _, params, _ := mime.ParseMediaType(res.Header.Get("Content-Disposition")); params["hash"] != "" {
+		hash = params["hash"]
+	}
+	validator := res.Header.Get("ETag")
+	if strings.HasPrefix(validator, "W/") { // 弱 ETag 不能用于 If-Range
+		validator = ""
+	}
+	if validator == "" {
+		validator = res.Header.Get("Last-Modified")
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK: // 不支持 Range、首次下载或者远端文件已变化，从头开始
+		if err = dl.truncate(); err != nil {
+			return false, err
+		}
+		dl.total = res.ContentLength
+		dl.hash, dl.validator = hash, validator
+		if err = dl.save(); err != nil {
+			return false, err
+		}
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(res.Header.Get("Content-Range"))
+		if !ok || start != dl.written {
+			_ = dl.truncate()
+			return false, errors.New("Content-Range 与请求不一致：" + res.Header.Get("Content-Range"))
+		}
+		if dl.changed(hash, validator) {
+			dl.tun.slog.Warnf("下载 %s 期间远端文件发生了变化，重新下载", dl.path)
+			if err = dl.truncate(); err != nil {
+				return false, err
+			}
+			dl.hash, dl.validator = "", ""
+			return dl.fetch(ctx)
+		}
+		dl.total = total
+		if (hash != "" && hash != dl.hash) || (validator != "" && validator != dl.validator) {
+			if hash != "" {
+				dl.hash = hash
+			}
+			if validator != "" {
+				dl.validator = validator
+			}
+			if err = dl.save(); err != nil {
+				return false, err
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable: // 临时文件比远端文件大，重新下载
+		if err = dl.truncate(); err != nil {
+			return false, err
+		}
+		return dl.fetch(ctx)
+	default:
+		buf := make([]byte, 1024)
+		n, _ := io.ReadFull(res.Body, buf)
+		return false, &netutil.HTTPError{Code: res.StatusCode, Header: res.Header, Body: buf[:n]}
+	}
+
+	if _, err = dl.file.Seek(dl.written, io.SeekStart); err != nil {
+		return false, err
+	}
+	dl.report()
+	buf := make([]byte, 32*1024)
+	for {
+		n, exx := res.Body.Read(buf)
+		if n > 0 {
+			if _, err = dl.file.Write(buf[:n]); err != nil {
+				return false, err
+			}
+			dl.written += int64(n)
+			dl.report()
+		}
+		if exx == io.EOF {
+			break
+		} else if exx != nil {
+			return false, exx
+		}
+	}
+	if dl.total >= 0 && dl.written != dl.total {
+		return false, io.ErrUnexpectedEOF
+	}
+
+	return true, nil
+}
+
+// changed 续传的响应与之前的响应是否属于不同版本的文件。
+func (dl *download) changed(hash, validator string) bool {
+	if dl.hash != "" && hash != "" && !strings.EqualFold(dl.hash, hash) {
+		return true
+	}
+
+	return dl.validator != "" && validator != "" && dl.validator != validator
+}
+
+// downloadMeta 临时文件对应的远端文件版本。
+type downloadMeta struct {
+	Hash      string `json:"hash,omitempty"`
+	Validator string `json:"validator,omitempty"`
+}
+
+// restore 读取上次下载记录的远端文件版本，没有可用于比较的版本时返回 false。
+func (dl *download) restore() bool {
+	raw, err := os.ReadFile(dl.meta)
+	if err != nil {
+		return false
+	}
+	var meta downloadMeta
+	if err = json.Unmarshal(raw, &meta); err != nil {
+		return false
+	}
+	dl.hash, dl.validator = meta.Hash, meta.Validator
+
+	return dl.hash != "" || dl.validator != ""
+}
+
+func (dl *download) save() error {
+	raw, err := json.Marshal(downloadMeta{Hash: dl.hash, Validator: dl.validator})
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dl.meta, raw, 0o644)
+}
+
+// discard 删除临时文件，用于无法续传的失败。
+func (dl *download) discard() {
+	_ = dl.file.Close()
+	_ = os.Remove(dl.file.Name())
+	_ = os.Remove(dl.meta)
+}
+
+func (dl *download) truncate() error {
+	dl.written = 0
+	return dl.file.Truncate(0)
+}
+
+func (dl *download) report() {
+	if dl.progress != nil {
+		dl.progress(dl.written, dl.total)
+	}
+}
+
+// parseContentRange 解析 bytes start-end/total，total 未知时为 -1。
+func parseContentRange(s string) (start, total int64, ok bool) {
+	s, ok = strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	rng, size, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	var err error
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+
+	return start, total, true
+}
+
+// awaitReady 等待通道可用，至少间隔 1s，防止通道正常但请求一直失败时空转。
+func (bt *borerTunnel) awaitReady(ctx context.Context) error {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return bt.awaitSession(ctx)
+}
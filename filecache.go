@@ -0,0 +1,433 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+)
+
+// CachedFile 缓存中的文件。
+type CachedFile struct {
+	Name     string    `json:"name"`    // 文件名，即 fs.FS 中的路径
+	Hash     string    `json:"hash"`    // 文件 MD5
+	Size     int64     `json:"size"`    // 文件大小
+	Path     string    `json:"-"`       // 文件在本地磁盘的路径，只读
+	UsedAt   time.Time `json:"used_at"` // 最近一次使用的时间
+	Modified bool      `json:"-"`       // 本次获取时是否下载了新的内容
+}
+
+// FileCache 三方文件、升级包等 broker 文件的本地缓存。
+//
+// 文件按照内容的 MD5 存储（内容寻址），获取文件时会自动带上本地文件的 hash 参数，
+// broker 响应 304 时直接使用本地文件。缓存超过容量时按照最近最少使用（LRU）淘汰。
+// 打开缓存时会校验每个文件的 MD5，损坏的文件会被删除。
+//
+//	cache, err := tunnel.OpenFileCache(tun, "/var/lib/ssoc/cache", 512<<20)
+//	f, err := cache.Third(ctx, "ip2region.db")
+//	data, err := fs.ReadFile(cache.FS(), "ip2region.db")
+//
+// 同一时刻只会下载一个文件，其它的获取请求会排队等待。
+type FileCache struct {
+	tun      Tunneler
+	dir      string
+	maxBytes int64
+	mutex    sync.Mutex
+	files    map[string]*CachedFile
+	dmu      sync.Mutex // 串行下载
+}
+
+// OpenFileCache 打开（不存在则创建）目录 dir 下的文件缓存，maxBytes 小于等于 0 时不限制容量。
+func OpenFileCache(tun Tunneler, dir string, maxBytes int64) (*FileCache, error) {
+	for _, sub := range []string{"objects", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	fc := &FileCache{tun: tun, dir: dir, maxBytes: maxBytes, files: make(map[string]*CachedFile, 16)}
+	if err := fc.load(); err != nil {
+		return nil, err
+	}
+
+	return fc, nil
+}
+
+// Third 获取三方文件 name（/api/v1/broker/third）。
+func (fc *FileCache) Third(ctx context.Context, name string) (*CachedFile, error) {
+	return fc.Get(ctx, name, "/api/v1/broker/third?"+url.Values{"name": []string{name}}.Encode())
+}
+
+// Get 通过 broker 接口 path 获取文件并缓存为 name，name 只能是单个文件名，不能包含 / 或者 \。
+// 本地已有缓存时会在 path 的查询参数中带上 hash，broker 响应 304 时直接返回缓存。
+func (fc *FileCache) Get(ctx context.Context, name, path string) (*CachedFile, error) {
+	if !validCacheName(name) {
+		return nil, &fs.PathError{Op: "get", Path: name, Err: fs.ErrInvalid}
+	}
+
+	fc.dmu.Lock()
+	defer fc.dmu.Unlock()
+
+	if old := fc.lookup(name); old != nil {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("hash", old.Hash)
+		u.RawQuery = q.Encode()
+		path = u.String()
+	}
+
+	tmp := filepath.Join(fc.dir, "tmp", name)
+	err := fc.tun.DownloadFile(ctx, path, tmp, nil)
+	var he *netutil.HTTPError
+	if errors.As(err, &he) && he.Code == http.StatusNotModified {
+		if f := fc.touch(name); f != nil {
+			return f, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return fc.store(name, tmp)
+}
+
+// Lookup 获取缓存中的文件，不会访问 broker。
+func (fc *FileCache) Lookup(name string) (*CachedFile, bool) {
+	f := fc.touch(name)
+	return f, f != nil
+}
+
+// Files 缓存中的全部文件。
+func (fc *FileCache) Files() []CachedFile {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	ret := make([]CachedFile, 0, len(fc.files))
+	for _, f := range fc.files {
+		ret = append(ret, *f)
+	}
+	slices.SortFunc(ret, func(a, b CachedFile) int { return strings.Compare(a.Name, b.Name) })
+
+	return ret
+}
+
+// Remove 从缓存中删除文件。
+func (fc *FileCache) Remove(name string) error {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	f := fc.files[name]
+	if f == nil {
+		return nil
+	}
+	delete(fc.files, name)
+	fc.release(f.Hash)
+
+	return fc.save()
+}
+
+// FS 缓存文件的只读视图，文件名即 Get 时传入的 name。
+func (fc *FileCache) FS() fs.FS {
+	return cacheFS{fc: fc}
+}
+
+// lookup 查找缓存，不更新使用时间。
+func (fc *FileCache) lookup(name string) *CachedFile {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	if f := fc.files[name]; f != nil {
+		cp := *f
+		return &cp
+	}
+
+	return nil
+}
+
+// touch 查找缓存并更新使用时间，使用时间只在缓存变化时才会写入索引文件。
+func (fc *FileCache) touch(name string) *CachedFile {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	f := fc.files[name]
+	if f == nil {
+		return nil
+	}
+	f.UsedAt = time.Now()
+	cp := *f
+
+	return &cp
+}
+
+// store 将下载完成的文件 tmp 移入缓存。
+func (fc *FileCache) store(name, tmp string) (*CachedFile, error) {
+	sum, size, err := fileMD5(tmp)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+
+	obj := fc.object(sum)
+	if err = os.Rename(tmp, obj); err != nil {
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	old := fc.files[name]
+	f := &CachedFile{Name: name, Hash: sum, Size: size, Path: obj, UsedAt: time.Now()}
+	fc.files[name] = f
+	if old != nil && old.Hash != sum {
+		fc.release(old.Hash)
+	}
+	fc.evict(name)
+	if err = fc.save(); err != nil {
+		return nil, err
+	}
+	cp := *f
+	cp.Modified = true
+
+	return &cp, nil
+}
+
+// evict 超过容量时按照 LRU 淘汰，keep 为刚刚加入的文件，不会被淘汰。调用方需持有锁。
+func (fc *FileCache) evict(keep string) {
+	if fc.maxBytes <= 0 {
+		return
+	}
+
+	files := make([]*CachedFile, 0, len(fc.files))
+	for _, f := range fc.files {
+		files = append(files, f)
+	}
+	slices.SortFunc(files, func(a, b *CachedFile) int { return a.UsedAt.Compare(b.UsedAt) })
+	for _, f := range files {
+		if fc.usage() <= fc.maxBytes {
+			return
+		}
+		if f.Name != keep {
+			delete(fc.files, f.Name)
+			fc.release(f.Hash)
+		}
+	}
+}
+
+// usage 缓存占用的磁盘空间，相同内容的文件只计算一次。调用方需持有锁。
+func (fc *FileCache) usage() int64 {
+	seen := make(map[string]struct{}, len(fc.files))
+	var total int64
+	for _, f := range fc.files {
+		if _, ok := seen[f.Hash]; !ok {
+			seen[f.Hash] = struct{}{}
+			total += f.Size
+		}
+	}
+
+	return total
+}
+
+// release 没有文件再引用 hash 时删除对应的内容。调用方需持有锁。
+func (fc *FileCache) release(hash string) {
+	for _, f := range fc.files {
+		if f.Hash == hash {
+			return
+		}
+	}
+	_ = os.Remove(fc.object(hash))
+}
+
+// validCacheName name 是否为单个本地文件名。Windows 下 \ 也是路径分隔符，
+// 只检查 / 的话 ..\..\x 会写到缓存目录之外。
+func validCacheName(name string) bool {
+	return fs.ValidPath(name) && name != "." && !strings.ContainsAny(name, `/\`) && filepath.IsLocal(name)
+}
+
+func (fc *FileCache) object(hash string) string {
+	return filepath.Join(fc.dir, "objects", hash)
+}
+
+// load 读取索引并校验文件，只在打开缓存时调用。
+func (fc *FileCache) load() error {
+	var files []*CachedFile
+	if raw, err := os.ReadFile(filepath.Join(fc.dir, "index.json")); err == nil {
+		_ = json.Unmarshal(raw, &files)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	verified := make(map[string]bool, len(files))
+	for _, f := range files {
+		if f == nil || !validCacheName(f.Name) { // 索引文件可能被篡改
+			continue
+		}
+		ok, seen := verified[f.Hash]
+		if !seen {
+			sum, size, err := fileMD5(fc.object(f.Hash))
+			ok = err == nil && strings.EqualFold(sum, f.Hash) && size == f.Size
+			verified[f.Hash] = ok
+		}
+		if ok {
+			f.Path = fc.object(f.Hash)
+			fc.files[f.Name] = f
+		}
+	}
+
+	// 删除损坏的文件与未被引用的文件，tmp 目录中未下载完成的文件保留用于续传
+	entries, err := os.ReadDir(filepath.Join(fc.dir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, ent := range entries {
+		if !verified[ent.Name()] {
+			_ = os.Remove(filepath.Join(fc.dir, "objects", ent.Name()))
+		}
+	}
+	fc.evict("")
+
+	return fc.save()
+}
+
+// save 保存索引，调用方需持有锁。
+func (fc *FileCache) save() error {
+	files := make([]*CachedFile, 0, len(fc.files))
+	for _, f := range fc.files {
+		files = append(files, f)
+	}
+	raw, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(fc.dir, "index.json")
+	tmp := name + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// fileMD5 计算文件的 MD5 与大小。
+func fileMD5(name string) (string, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	h := md5.New()
+	n, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// cacheFS 缓存文件的 fs.FS 视图。
+type cacheFS struct {
+	fc *FileCache
+}
+
+func (cf cacheFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return &cacheDir{files: cf.fc.Files()}, nil
+	}
+
+	f := cf.fc.touch(name)
+	if f == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &cacheFile{File: file, info: cacheInfo{f: *f}}, nil
+}
+
+// cacheFile 打开的缓存文件，Stat 返回的名字为缓存中的文件名。
+type cacheFile struct {
+	*os.File
+	info cacheInfo
+}
+
+func (cf *cacheFile) Stat() (fs.FileInfo, error) {
+	return cf.info, nil
+}
+
+// cacheDir 缓存的根目录。
+type cacheDir struct {
+	files []CachedFile
+	off   int
+}
+
+func (cd *cacheDir) Stat() (fs.FileInfo, error) { return cacheInfo{dir: true}, nil }
+func (cd *cacheDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: ".", Err: errors.New("is a directory")}
+}
+func (cd *cacheDir) Close() error { return nil }
+
+func (cd *cacheDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := cd.files[cd.off:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	cd.off += len(rest)
+
+	ents := make([]fs.DirEntry, 0, len(rest))
+	for _, f := range rest {
+		ents = append(ents, fs.FileInfoToDirEntry(cacheInfo{f: f}))
+	}
+
+	return ents, nil
+}
+
+type cacheInfo struct {
+	f   CachedFile
+	dir bool
+}
+
+func (ci cacheInfo) Name() string {
+	if ci.dir {
+		return "."
+	}
+	return ci.f.Name
+}
+
+func (ci cacheInfo) Size() int64 { return ci.f.Size }
+
+func (ci cacheInfo) Mode() fs.FileMode {
+	if ci.dir {
+		return fs.ModeDir | 0o555
+	}
+	return 0o444
+}
+
+func (ci cacheInfo) ModTime() time.Time { return ci.f.UsedAt }
+func (ci cacheInfo) IsDir() bool        { return ci.dir }
+func (ci cacheInfo) Sys() any           { return nil }
@@ -0,0 +1,405 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ForwardSpec 端口转发规则：在本地监听 Local，将连接经由 broker 转发至 Remote。
+type ForwardSpec struct {
+	Network string `json:"network"` // tcp 或 udp，默认 tcp
+	Local   string `json:"local"`   // 本地监听地址，例如：127.0.0.1:13306
+	Remote  string `json:"remote"`  // broker 所在网络中的目标地址，必须带端口号，例如：10.0.0.5:3306
+}
+
+// ForwardConn 一个正在转发的连接，UDP 则为同一个客户端地址的会话。
+type ForwardConn struct {
+	Spec   ForwardSpec // 转发规则
+	Client net.Addr    // 本地客户端地址
+	Start  time.Time   // 开始时间
+	tx     atomic.Int64
+	rx     atomic.Int64
+}
+
+// Sent 本地客户端发往远端的字节数。
+func (fc *ForwardConn) Sent() int64 {
+	return fc.tx.Load()
+}
+
+// Received 远端发往本地客户端的字节数。
+func (fc *ForwardConn) Received() int64 {
+	return fc.rx.Load()
+}
+
+// Forwarder 端口转发器。
+//
+// 转发基于 broker 的 /api/v1/broker/stream/tunnel 接口，每个本地连接（UDP 为每个客户端地址）
+// 都会在通道上建立一个新的流。通道断开期间会关闭本地监听，重连成功后自动重新监听，
+// 这样本地客户端在断线期间会快速失败，而不是一直挂起。
+type Forwarder struct {
+	// OnClose 连接结束时的回调，可用于记录流量，err 为连接结束的原因。
+	OnClose func(fc *ForwardConn, err error)
+
+	// OnListenError 重连后重新监听失败时的回调，可以为 nil。
+	// 失败的规则会按照 1s、2s、4s ... 最长 30s 的间隔重试，其它规则不受影响。
+	OnListenError func(spec ForwardSpec, err error)
+
+	// UDPIdleTimeout UDP 会话的空闲超时时间，默认 1min。
+	UDPIdleTimeout time.Duration
+
+	tun   Tunneler
+	specs []ForwardSpec
+	mutex sync.Mutex
+	conns map[*ForwardConn]struct{}
+}
+
+// NewForwarder 创建端口转发器，调用 Run 开始转发。
+func NewForwarder(tun Tunneler, specs ...ForwardSpec) *Forwarder {
+	return &Forwarder{
+		tun:   tun,
+		specs: specs,
+		conns: make(map[*ForwardConn]struct{}, 16),
+	}
+}
+
+// Conns 正在转发的连接。
+func (f *Forwarder) Conns() []*ForwardConn {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ret := make([]*ForwardConn, 0, len(f.conns))
+	for fc := range f.conns {
+		ret = append(ret, fc)
+	}
+
+	return ret
+}
+
+// Run 开始转发，直至 ctx 结束、通道关闭（返回 ErrTunnelClosed）或者首次本地监听失败。
+// 重连后重新监听失败时不会返回，而是通过 OnListenError 通知并定时重试。
+func (f *Forwarder) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lns := make([]io.Closer, len(f.specs)) // 与 specs 一一对应，nil 代表未监听
+	closeAll := func() {
+		for i, ln := range lns {
+			if ln != nil {
+				_ = ln.Close()
+				lns[i] = nil
+			}
+		}
+	}
+	defer closeAll()
+
+	retry := time.NewTimer(time.Hour)
+	retry.Stop()
+	defer retry.Stop()
+
+	var connected, listened bool // listened 代表首次监听已经成功
+	delay := time.Second
+	events := f.tun.Subscribe(ctx)
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				return ctx.Err()
+			}
+			switch evt.To {
+			case StateConnected:
+				connected = true
+			case StateShutdown:
+				return ErrTunnelClosed
+			default: // 通道断开，关闭本地监听，重连后重新监听
+				connected = false
+				retry.Stop()
+				closeAll()
+				continue
+			}
+		case <-retry.C:
+			if !connected {
+				continue
+			}
+		}
+
+		var failed bool
+		for i, spec := range f.specs {
+			if lns[i] != nil {
+				continue
+			}
+			ln, err := f.listen(ctx, spec)
+			if err != nil {
+				if !listened { // 首次监听失败一般是配置错误，直接返回
+					return err
+				}
+				failed = true
+				if fn := f.OnListenError; fn != nil {
+					fn(spec, err)
+				}
+				continue
+			}
+			lns[i] = ln
+		}
+		listened = true
+		if failed {
+			retry.Reset(delay)
+			delay = min(2*delay, 30*time.Second)
+		} else {
+			delay = time.Second
+		}
+	}
+}
+
+func (f *Forwarder) listen(ctx context.Context, spec ForwardSpec) (io.Closer, error) {
+	if spec.Network == "udp" {
+		pc, err := net.ListenPacket("udp", spec.Local)
+		if err != nil {
+			return nil, err
+		}
+		go f.serveUDP(ctx, spec, pc)
+		return pc, nil
+	}
+
+	ln, err := net.Listen("tcp", spec.Local)
+	if err != nil {
+		return nil, err
+	}
+	go f.serveTCP(ctx, spec, ln)
+
+	return ln, nil
+}
+
+func (f *Forwarder) serveTCP(ctx context.Context, spec ForwardSpec, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.pipeTCP(ctx, spec, conn)
+	}
+}
+
+func (f *Forwarder) pipeTCP(ctx context.Context, spec ForwardSpec, conn net.Conn) {
+	fc := f.track(spec, conn.RemoteAddr())
+	ws, err := dialRelay(ctx, f.tun, "tcp", spec.Remote)
+	if err != nil {
+		_ = conn.Close()
+		f.untrack(fc, err)
+		return
+	}
+	remote := &websocketConn{ws: ws, rd: websocket.JoinMessages(ws, "")}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, exx := io.Copy(&countWriter{w: remote, n: &fc.tx}, conn)
+		errc <- exx
+	}()
+	go func() {
+		_, exx := io.Copy(&countWriter{w: conn, n: &fc.rx}, remote)
+		errc <- exx
+	}()
+	err = <-errc
+	_ = conn.Close()
+	_ = remote.Close()
+	<-errc
+
+	f.untrack(fc, err)
+}
+
+func (f *Forwarder) serveUDP(ctx context.Context, spec ForwardSpec, pc net.PacketConn) {
+	idle := f.UDPIdleTimeout
+	if idle <= 0 {
+		idle = time.Minute
+	}
+	uf := &udpForward{f: f, spec: spec, pc: pc, idle: idle, sessions: make(map[string]*udpSession, 16)}
+	defer uf.close()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		uf.send(ctx, addr, buf[:n])
+	}
+}
+
+// forwardMaxQueue UDP 会话的流建立期间最多缓存的数据报数，超出后丢弃。
+const forwardMaxQueue = 32
+
+// udpForward 一条 UDP 转发规则的本地监听，每个客户端地址对应一个会话。
+type udpForward struct {
+	f        *Forwarder
+	spec     ForwardSpec
+	pc       net.PacketConn
+	idle     time.Duration
+	mutex    sync.Mutex
+	sessions map[string]*udpSession
+	closed   bool
+}
+
+// send 转发客户端 addr 的数据报。会话不存在时在后台建立，期间的数据报缓存在队列中，
+// 不阻塞其它客户端的转发。
+func (uf *udpForward) send(ctx context.Context, addr net.Addr, data []byte) {
+	key := addr.String()
+	uf.mutex.Lock()
+	sess := uf.sessions[key]
+	switch {
+	case sess == nil:
+		fc := uf.f.track(uf.spec, addr)
+		sess = &udpSession{fc: fc, idle: uf.idle, queue: [][]byte{bytes.Clone(data)}}
+		uf.sessions[key] = sess
+		uf.mutex.Unlock()
+		go uf.open(ctx, key, addr, sess)
+		return
+	case sess.ws == nil:
+		if len(sess.queue) < forwardMaxQueue {
+			sess.queue = append(sess.queue, bytes.Clone(data))
+		}
+		uf.mutex.Unlock()
+		return
+	}
+	uf.mutex.Unlock()
+
+	sess.send(data)
+}
+
+// open 建立会话的流，发送缓存的数据报后转发远端的响应，直至会话结束。
+func (uf *udpForward) open(ctx context.Context, key string, addr net.Addr, sess *udpSession) {
+	ws, err := dialRelay(ctx, uf.f.tun, "udp", uf.spec.Remote)
+	uf.mutex.Lock()
+	if err == nil && uf.closed {
+		_ = ws.Close()
+		err = net.ErrClosed
+	}
+	if err != nil {
+		delete(uf.sessions, key)
+		uf.mutex.Unlock()
+		uf.f.untrack(sess.fc, err)
+		return
+	}
+	queue := sess.queue
+	sess.ws, sess.queue = ws, nil
+	uf.mutex.Unlock()
+
+	for _, data := range queue {
+		sess.send(data)
+	}
+	err = sess.receive(uf.pc, addr)
+	uf.mutex.Lock()
+	if uf.sessions[key] == sess {
+		delete(uf.sessions, key)
+	}
+	uf.mutex.Unlock()
+	uf.f.untrack(sess.fc, err)
+}
+
+func (uf *udpForward) close() {
+	uf.mutex.Lock()
+	defer uf.mutex.Unlock()
+
+	uf.closed = true
+	for _, sess := range uf.sessions {
+		if sess.ws != nil {
+			_ = sess.ws.Close()
+		}
+	}
+}
+
+// dialRelay 通过 broker 的 /api/v1/broker/stream/tunnel 接口连接远端地址，network 为 tcp 或 udp。
+// UDP 的每个数据报对应一个 websocket 消息。
+func dialRelay(ctx context.Context, tun Tunneler, network, remote string) (*websocket.Conn, error) {
+	dialer := &websocket.Dialer{
+		NetDialContext:   tun.DialContext,
+		HandshakeTimeout: 30 * time.Second,
+	}
+	query := url.Values{"address": []string{network + "://" + remote}}
+	u := &url.URL{Scheme: "ws", Host: "soc", Path: "/api/v1/broker/stream/tunnel", RawQuery: query.Encode()}
+	ws, _, err := dialer.DialContext(ctx, u.String(), nil)
+
+	return ws, err
+}
+
+func (f *Forwarder) track(spec ForwardSpec, client net.Addr) *ForwardConn {
+	fc := &ForwardConn{Spec: spec, Client: client, Start: time.Now()}
+	f.mutex.Lock()
+	f.conns[fc] = struct{}{}
+	f.mutex.Unlock()
+
+	return fc
+}
+
+func (f *Forwarder) untrack(fc *ForwardConn, err error) {
+	f.mutex.Lock()
+	delete(f.conns, fc)
+	f.mutex.Unlock()
+
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	if fn := f.OnClose; fn != nil {
+		fn(fc, err)
+	}
+}
+
+// udpSession 一个 UDP 客户端的会话，每个数据报对应一个 websocket 消息以保留报文边界。
+// ws 为 nil 代表流正在建立，期间的数据报缓存在 queue 中。
+type udpSession struct {
+	ws    *websocket.Conn
+	queue [][]byte
+	fc    *ForwardConn
+	idle  time.Duration
+	wmu   sync.Mutex
+}
+
+func (us *udpSession) send(data []byte) {
+	us.wmu.Lock()
+	err := us.ws.WriteMessage(websocket.BinaryMessage, data)
+	us.wmu.Unlock()
+	if err == nil {
+		us.fc.tx.Add(int64(len(data)))
+		_ = us.ws.SetReadDeadline(time.Now().Add(us.idle))
+	}
+}
+
+func (us *udpSession) receive(pc net.PacketConn, addr net.Addr) error {
+	//goland:noinspection GoUnhandledErrorResult
+	defer us.ws.Close()
+
+	for {
+		_ = us.ws.SetReadDeadline(time.Now().Add(us.idle))
+		_, data, err := us.ws.ReadMessage()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() { // 空闲超时
+				return nil
+			}
+			return err
+		}
+		if _, err = pc.WriteTo(data, addr); err != nil {
+			return err
+		}
+		us.fc.rx.Add(int64(len(data)))
+	}
+}
+
+// countWriter 统计写入的字节数。
+type countWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
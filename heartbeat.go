@@ -0,0 +1,335 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"runtime"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatWindow   = 100              // 统计 RTT 与丢失率的最近心跳次数
+	heartbeatFailures = 5                // 心跳连续失败该次数后主动断开连接
+	heartbeatTimeout  = time.Minute      // 每次心跳包发送的超时时间
+	heartbeatMinimum  = time.Minute      // 心跳间隔的下限
+	heartbeatMaximum  = 20 * time.Minute // 心跳间隔的上限
+)
+
+// HeartbeatStats 心跳统计，RTT 分位数与丢失率基于最近 100 次心跳计算。
+type HeartbeatStats struct {
+	Interval    time.Duration `json:"interval"`     // 当前心跳间隔，0 代表未开启心跳
+	Sent        uint64        `json:"sent"`         // 心跳发送总次数
+	Lost        uint64        `json:"lost"`         // 心跳失败总次数
+	Failures    int           `json:"failures"`     // 心跳连续失败次数
+	LossRate    float64       `json:"loss_rate"`    // 最近心跳的丢失率，取值 0-1
+	LastRTT     time.Duration `json:"last_rtt"`     // 最近一次成功心跳的往返时延
+	P50         time.Duration `json:"p50"`          // 最近成功心跳 RTT 的 50 分位数
+	P90         time.Duration `json:"p90"`          // 最近成功心跳 RTT 的 90 分位数
+	P99         time.Duration `json:"p99"`          // 最近成功心跳 RTT 的 99 分位数
+	LastSuccess time.Time     `json:"last_success"` // 最近一次心跳成功的时间
+}
+
+// HeartbeatPayload 心跳报文提供者，每次发送心跳前调用，返回值使用 Coder 编码后作为心跳报文，
+// 返回 nil 时心跳不携带报文。snap 为通道采集的运行状态快照，可以补充 Checks 后直接返回，
+// 也可以嵌入自定义的报文中。ctx 为本次心跳的上下文，提供者不应长时间阻塞。
+type HeartbeatPayload func(ctx context.Context, snap HealthSnapshot) any
+
+// HealthSnapshot 节点运行状态快照，可以直接作为心跳报文，也可以嵌入自定义的心跳报文中。
+type HealthSnapshot struct {
+	Goroutines int               `json:"goroutines"`       // 协程数量
+	HeapAlloc  uint64            `json:"heap_alloc"`       // 堆内存占用（字节）
+	Sys        uint64            `json:"sys"`              // 向操作系统申请的内存（字节）
+	Streams    int               `json:"streams"`          // 当前会话打开的流数量
+	Outbox     int               `json:"outbox"`           // 离线上报队列深度
+	RTT        time.Duration     `json:"rtt"`              // 最近一次成功心跳的往返时延
+	Checks     map[string]string `json:"checks,omitempty"` // agent 自身的健康检查结果，由调用方填充
+}
+
+// heartbeatReply 心跳响应，broker 可以通过 interval 调整节点的心跳间隔，
+// 与 Ident.Interval 一样以纳秒为单位，为 0 或者响应报文为空时不调整。
+type heartbeatReply struct {
+	Interval time.Duration `json:"interval"`
+}
+
+// heartbeatSample 一次心跳的结果。
+type heartbeatSample struct {
+	rtt time.Duration
+	ok  bool
+}
+
+// Heartbeat 心跳控制器，定期向 broker 发送心跳（POST /api/v1/minion/ping）并统计往返时延。
+//
+// 心跳连续失败 5 次后会主动断开连接。心跳间隔可以通过 SetInterval 调整，
+// 也可以由 broker 在心跳响应中下发。中心端按照握手时上报的间隔监控心跳，
+// 3 倍间隔内没有收到消息就会断开连接，所以生效的间隔不会超过握手时上报间隔的 2 倍，
+// 为网络延迟和心跳失败重试留出余量，超出的部分在下次重连握手后生效。
+type Heartbeat struct {
+	bt       *borerTunnel
+	probe    time.Duration     // 心跳失败后快速探测的初始间隔，0 代表不探测
+	payload  HeartbeatPayload  // 心跳报文提供者，可能为 nil
+	mutex    sync.Mutex        // 保护以下字段
+	interval time.Duration     // 当前生效的心跳间隔
+	want     time.Duration     // 期望的心跳间隔，下次握手时上报并生效
+	reported time.Duration     // 最近一次握手时上报的心跳间隔
+	samples  []heartbeatSample // 最近的心跳结果，环形缓冲区
+	next     int               // 下一个写入 samples 的位置
+	stats    HeartbeatStats    // 累计的统计数据
+	reset    chan struct{}     // 心跳间隔变化，重新计时
+	now      chan struct{}     // 立即发送一次心跳
+}
+
+func newHeartbeat(bt *borerTunnel, interval, probe time.Duration, payload HeartbeatPayload) *Heartbeat {
+	return &Heartbeat{
+		bt:       bt,
+		probe:    probe,
+		payload:  payload,
+		interval: interval,
+		want:     interval,
+		reported: interval,
+		samples:  make([]heartbeatSample, 0, heartbeatWindow),
+		reset:    make(chan struct{}, 1),
+		now:      make(chan struct{}, 1),
+	}
+}
+
+// Interval 当前心跳间隔，0 代表未开启心跳。
+func (hb *Heartbeat) Interval() time.Duration {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+
+	return hb.interval
+}
+
+// SetInterval 调整心跳间隔并重新计时，du 小于等于 0 时暂停心跳，
+// 大于 0 时有效值在 1min - 20min 之间，超出范围时取边界值。
+//
+// 调大的间隔在下次重连时才会告知中心端，在此之前生效的间隔不超过握手时上报间隔的 2 倍，
+// 避免中心端因为超时断开连接，重连握手后 du 完全生效。
+func (hb *Heartbeat) SetInterval(du time.Duration) {
+	hb.mutex.Lock()
+	hb.setInterval(du)
+	hb.mutex.Unlock()
+
+	hb.reschedule()
+}
+
+// setInterval 设置期望的心跳间隔，生效的间隔不超过握手时上报间隔的 2 倍，调用方需持有锁。
+func (hb *Heartbeat) setInterval(du time.Duration) {
+	hb.want = clampInterval(du)
+	hb.interval = hb.want
+	if limit := 2 * hb.reported; limit > 0 && hb.interval > limit {
+		hb.interval = limit
+	}
+}
+
+// handshake 握手时调用，返回要上报给中心端的心跳间隔，期望的间隔从此完全生效。
+func (hb *Heartbeat) handshake() time.Duration {
+	hb.mutex.Lock()
+	hb.reported = hb.want
+	hb.interval = hb.want
+	du := hb.reported
+	hb.mutex.Unlock()
+
+	hb.reschedule()
+
+	return du
+}
+
+// reschedule 心跳间隔变化后重新计时。
+func (hb *Heartbeat) reschedule() {
+	select {
+	case hb.reset <- struct{}{}:
+	default:
+	}
+}
+
+// Probe 立即发送一次心跳，不会等待心跳结果。心跳暂停时也会发送。
+func (hb *Heartbeat) Probe() {
+	select {
+	case hb.now <- struct{}{}:
+	default:
+	}
+}
+
+// Stats 心跳统计。
+func (hb *Heartbeat) Stats() HeartbeatStats {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+
+	stats := hb.stats
+	stats.Interval = hb.interval
+	rtts := make([]time.Duration, 0, len(hb.samples))
+	for _, s := range hb.samples {
+		if s.ok {
+			rtts = append(rtts, s.rtt)
+		}
+	}
+	if n := len(hb.samples); n != 0 {
+		stats.LossRate = float64(n-len(rtts)) / float64(n)
+	}
+	if len(rtts) != 0 {
+		slices.Sort(rtts)
+		stats.P50 = percentile(rtts, 50)
+		stats.P90 = percentile(rtts, 90)
+		stats.P99 = percentile(rtts, 99)
+	}
+
+	return stats
+}
+
+// snapshot 采集节点运行状态快照。
+func (hb *Heartbeat) snapshot() HealthSnapshot {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	snap := HealthSnapshot{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		Sys:        mem.Sys,
+		Outbox:     hb.bt.outbox.Len(),
+	}
+	if sess := hb.bt.session(); sess != nil && !sess.IsClosed() {
+		snap.Streams = sess.NumStreams()
+	}
+	hb.mutex.Lock()
+	snap.RTT = hb.stats.LastRTT
+	hb.mutex.Unlock()
+
+	return snap
+}
+
+// run 心跳循环，直至通道关闭。
+func (hb *Heartbeat) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		timer.Stop()
+		var timeout <-chan time.Time // 心跳暂停时为 nil，只响应 Probe 与 SetInterval
+		if du := hb.delay(); du > 0 {
+			timer.Reset(du)
+			timeout = timer.C
+		}
+
+		select {
+		case <-hb.bt.parent.Done():
+			return
+		case <-hb.reset:
+		case <-hb.now:
+			hb.beat()
+		case <-timeout:
+			hb.beat()
+		}
+	}
+}
+
+// delay 距离下次心跳的时长，心跳失败后按照 probe 的倍数快速探测，但不超过心跳间隔。
+func (hb *Heartbeat) delay() time.Duration {
+	hb.mutex.Lock()
+	defer hb.mutex.Unlock()
+
+	du := hb.interval
+	if n := hb.stats.Failures; n > 0 && hb.probe > 0 && du > 0 {
+		if probe := hb.probe << min(n-1, 16); probe < du {
+			du = probe
+		}
+	}
+
+	return du
+}
+
+// beat 发送一次心跳并记录结果。
+func (hb *Heartbeat) beat() {
+	start := time.Now()
+	reply, err := hb.send()
+	rtt := time.Since(start)
+
+	hb.mutex.Lock()
+	stats := &hb.stats
+	stats.Sent++
+	if err == nil {
+		stats.Failures = 0
+		stats.LastRTT, stats.LastSuccess = rtt, time.Now()
+		if du := reply.Interval; du > 0 {
+			hb.setInterval(du)
+		}
+	} else {
+		stats.Lost++
+		stats.Failures++
+	}
+	sample := heartbeatSample{rtt: rtt, ok: err == nil}
+	if len(hb.samples) < heartbeatWindow {
+		hb.samples = append(hb.samples, sample)
+	} else {
+		hb.samples[hb.next] = sample
+	}
+	hb.next = (hb.next + 1) % heartbeatWindow
+	failures, lost := stats.Failures, stats.Lost
+	if failures >= heartbeatFailures {
+		stats.Failures = 0
+	}
+	hb.mutex.Unlock()
+
+	if err == nil {
+		return
+	}
+	if failures >= heartbeatFailures {
+		hb.bt.slog.Warnf("连续 %d 次（总共失败 %d 次）心跳包发送失败：%s，主动断开连接", failures, lost, err)
+		_ = hb.bt.session().Close()
+	} else {
+		hb.bt.slog.Warnf("心跳包连续第 %d 次（总共失败 %d 次）发送失败：%s", failures, lost, err)
+	}
+}
+
+// send 发送心跳，心跳不进入离线队列。
+func (hb *Heartbeat) send() (heartbeatReply, error) {
+	bt := hb.bt
+	ctx, cancel := context.WithTimeout(bt.parent, heartbeatTimeout)
+	defer cancel()
+
+	var body io.Reader
+	var header http.Header
+	if hb.payload != nil {
+		if v := hb.payload(ctx, hb.snapshot()); v != nil {
+			buf := new(bytes.Buffer)
+			if err := bt.coder.NewEncoder(buf).Encode(v); err != nil {
+				bt.slog.Warnf("心跳报文编码失败，本次心跳不携带报文：%s", err)
+			} else {
+				body = buf
+				header = http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+			}
+		}
+	}
+
+	var reply heartbeatReply
+	res, err := bt.fetch(ctx, http.MethodPost, "/api/v1/minion/ping", body, header)
+	if err != nil {
+		return reply, err
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+
+	// 旧版本的 broker 响应报文为空，解析失败时忽略。
+	_ = bt.coder.NewDecoder(io.LimitReader(res.Body, 4096)).Decode(&reply)
+
+	return reply, nil
+}
+
+// clampInterval 将大于 0 的心跳间隔限制在 1min - 20min 之间。
+func clampInterval(du time.Duration) time.Duration {
+	if du <= 0 {
+		return 0
+	}
+
+	return min(max(du, heartbeatMinimum), heartbeatMaximum)
+}
+
+// percentile 计算已排序的 rtts 的 p 分位数。
+func percentile(rtts []time.Duration, p int) time.Duration {
+	idx := (len(rtts)*p+99)/100 - 1
+
+	return rtts[max(idx, 0)]
+}
@@ -45,6 +45,10 @@ type Address struct {
 	// 当开启 TLS 时该 Name 会被设置为校验证书的 Servername。
 	// 如果该字段为空，则默认使用 Addr 的地址作为主机名。
 	Name string `json:"name" yaml:"name"`
+
+	// Proxy 连接所经过的代理地址（已隐藏密码），直连时为空。
+	// 该字段只出现在连接成功后上报的地址中，不需要填写。
+	Proxy string `json:"proxy,omitempty" yaml:"proxy,omitempty"`
 }
 
 // String fmt.Stringer
@@ -62,6 +66,10 @@ func (ad Address) String() string {
 		build.WriteString(name)
 		build.WriteByte(')')
 	}
+	if proxy := ad.Proxy; proxy != "" {
+		build.WriteString(" via ")
+		build.WriteString(proxy)
+	}
 
 	return build.String()
 }
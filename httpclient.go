@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"net/http"
+	"time"
+)
+
+// newHTTPClient 创建经由通道访问 broker 接口的 HTTP 客户端。
+func newHTTPClient(bt *borerTunnel) (*http.Client, *http.Transport) {
+	trip := &http.Transport{
+		DialContext:           bt.dialContext,
+		MaxIdleConns:          64,
+		MaxIdleConnsPerHost:   16,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+		ExpectContinueTimeout: time.Second,
+	}
+	cli := &http.Client{Transport: &retryTransport{tun: bt, trip: trip}}
+
+	return cli, trip
+}
+
+// retryTransport 请求过程中会话断开时，幂等请求会等待重连成功后在新的会话上重试一次，
+// 等待时间受请求的 ctx 约束。
+type retryTransport struct {
+	tun  *borerTunnel
+	trip *http.Transport
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sess := rt.tun.session()
+	res, err := rt.trip.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil || !rewindable(req) {
+		return res, err
+	}
+	if sess != nil && !sess.IsClosed() && sess == rt.tun.session() {
+		return nil, err // 会话正常，不是断线导致的错误
+	}
+
+	retry := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	rt.trip.CloseIdleConnections()
+	// 默认配置下 DialContext 不等待重连，立即重试必然失败，需要先等到下一个会话。
+	if exx := rt.tun.awaitSession(req.Context()); exx != nil {
+		return nil, err
+	}
+
+	return rt.trip.RoundTrip(retry)
+}
+
+// rewindable 请求是否幂等且请求体可以重新读取。
+func rewindable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		if _, ok := req.Header["Idempotency-Key"]; !ok {
+			return false
+		}
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
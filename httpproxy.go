@@ -0,0 +1,255 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HTTPProxy 本地 HTTP 正向代理，支持普通请求与 CONNECT，所有出站连接都经由 broker 的
+// /api/v1/broker/stream/tunnel 接口转发，用于只支持 HTTP_PROXY 的第三方工具。
+//
+//	px := tunnel.NewHTTPProxy(tun)
+//	px.Addr = "127.0.0.1:3128"
+//	px.Username, px.Password = "ops", "secret"
+//	px.Allow = []string{"*.example.com", "10.0.0.0/8:443"}
+//	go px.ListenAndServe()
+type HTTPProxy struct {
+	// Addr 监听地址，默认 127.0.0.1:3128。
+	Addr string
+
+	// Username Password Basic 认证的用户名密码，Username 为空时不需要认证。
+	Username string
+	Password string
+
+	// Allow 允许访问的目标主机，为空代表允许所有目标，规则格式与 SOCKS5Server.Allow 一致。
+	Allow []string
+
+	tun   Tunneler
+	trip  *http.Transport
+	mutex sync.Mutex
+	srv   *http.Server
+}
+
+// NewHTTPProxy 创建经由通道出站的 HTTP 代理。
+func NewHTTPProxy(tun Tunneler) *HTTPProxy {
+	px := &HTTPProxy{tun: tun}
+	px.trip = &http.Transport{
+		DialContext:         px.dial,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+	}
+
+	return px
+}
+
+// ListenAndServe 监听 Addr 并提供服务。
+func (px *HTTPProxy) ListenAndServe() error {
+	addr := px.Addr
+	if addr == "" {
+		addr = "127.0.0.1:3128"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return px.Serve(ln)
+}
+
+// Serve 在 ln 上提供服务，直至 ln 关闭。
+func (px *HTTPProxy) Serve(ln net.Listener) error {
+	srv := &http.Server{Handler: px, ReadHeaderTimeout: 30 * time.Second}
+	px.mutex.Lock()
+	px.srv = srv
+	px.mutex.Unlock()
+
+	return srv.Serve(ln)
+}
+
+// Close 关闭监听与空闲的出站连接，CONNECT 隧道不受影响。
+func (px *HTTPProxy) Close() error {
+	px.trip.CloseIdleConnections()
+	px.mutex.Lock()
+	srv := px.srv
+	px.mutex.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	return srv.Close()
+}
+
+func (px *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !px.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="tunnel"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	dest := r.Host
+	if r.Method != http.MethodConnect {
+		if r.URL.Scheme != "http" || r.URL.Host == "" { // 只代理绝对地址的明文请求
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dest = r.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		port := "80"
+		if r.Method == http.MethodConnect {
+			port = "443"
+		}
+		dest = net.JoinHostPort(strings.Trim(dest, "[]"), port)
+	}
+	if !px.allowed(dest) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		px.connect(w, r, dest)
+	} else {
+		px.forward(w, r)
+	}
+}
+
+// connect 处理 CONNECT 请求。
+func (px *HTTPProxy) connect(w http.ResponseWriter, r *http.Request, dest string) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	remote, err := px.dial(r.Context(), "tcp", dest)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer remote.Close()
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	if _, err = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, exx := io.Copy(remote, brw.Reader) // 客户端可能已经发送了部分数据
+		errc <- exx
+	}()
+	go func() {
+		_, exx := io.Copy(conn, remote)
+		errc <- exx
+	}()
+	<-errc
+	_ = conn.Close()
+	_ = remote.Close()
+	<-errc
+}
+
+// forward 转发普通 HTTP 请求。
+func (px *HTTPProxy) forward(w http.ResponseWriter, r *http.Request) {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+
+	res, err := px.trip.RoundTrip(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer res.Body.Close()
+
+	removeHopHeaders(res.Header)
+	header := w.Header()
+	for k, vs := range res.Header {
+		header[k] = vs
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+func (px *HTTPProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ws, err := dialRelay(ctx, px.tun, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocketConn{ws: ws, rd: websocket.JoinMessages(ws, "")}, nil
+}
+
+// authorized 校验 Proxy-Authorization，使用常量时间比较，避免通过响应时间猜测。
+func (px *HTTPProxy) authorized(r *http.Request) bool {
+	if px.Username == "" {
+		return true
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+	username, passwd, _ := strings.Cut(string(raw), ":")
+
+	return subtle.ConstantTimeCompare([]byte(username), []byte(px.Username))&
+		subtle.ConstantTimeCompare([]byte(passwd), []byte(px.Password)) == 1
+}
+
+// allowed 目标地址是否允许访问。
+func (px *HTTPProxy) allowed(dest string) bool {
+	if len(px.Allow) == 0 {
+		return true
+	}
+	for _, rule := range px.Allow {
+		if matchDest(rule, dest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hopHeaders 逐跳首部，代理时不能转发（RFC 7230 6.1）。
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, k := range strings.Split(f, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/smux"
+)
+
+// BrokerConn broker 发起的流。
+//
+// 通过 Tunneler.Listener 或者 Server 接收到的连接都是 *BrokerConn，使用 net/http 时
+// 可以在 http.Server 的 ConnContext 中取出流的元数据：
+//
+//	srv := &http.Server{
+//		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+//			if bc, ok := c.(*tunnel.BrokerConn); ok {
+//				return context.WithValue(ctx, metaKey, bc.Meta())
+//			}
+//			return ctx
+//		},
+//	}
+type BrokerConn struct {
+	net.Conn
+	meta StreamMeta
+}
+
+// Meta 流的元数据。
+func (bc *BrokerConn) Meta() StreamMeta {
+	return bc.meta
+}
+
+// StreamMeta broker 发起的流的元数据。
+type StreamMeta struct {
+	ID       uint32    `json:"id"`       // 流 ID，同一个会话内唯一
+	Session  uint64    `json:"session"`  // 会话序号，从 1 开始，每次重连成功后加 1
+	Broker   *Address  `json:"broker"`   // 流所属会话连接的 broker 地址
+	Accepted time.Time `json:"accepted"` // 接收时间
+}
+
+// streamHub 汇聚每个会话中 broker 发起的流，使监听器在重连后依然有效。
+type streamHub struct {
+	accept chan *BrokerConn
+	done   chan struct{} // 通道关闭后关闭
+	once   sync.Once
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{
+		accept: make(chan *BrokerConn),
+		done:   make(chan struct{}),
+	}
+}
+
+// listen 创建一个监听器，多个监听器之间共同接收（争抢）broker 发起的流。
+func (sh *streamHub) listen() *hubListener {
+	return &hubListener{hub: sh, done: make(chan struct{})}
+}
+
+// close 关闭所有的监听器。
+func (sh *streamHub) close() {
+	sh.once.Do(func() { close(sh.done) })
+}
+
+// hubListener 跨会话长期有效的监听器，会话断开重连期间 Accept 会一直阻塞等待，
+// 只有监听器被关闭或者通道关闭后才会返回 net.ErrClosed。
+type hubListener struct {
+	hub  *streamHub
+	done chan struct{}
+	once sync.Once
+}
+
+func (hl *hubListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-hl.hub.accept:
+		return conn, nil
+	case <-hl.done:
+		return nil, net.ErrClosed
+	case <-hl.hub.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close 关闭监听器，不会影响通道以及已经接收的流。
+func (hl *hubListener) Close() error {
+	hl.once.Do(func() { close(hl.done) })
+	return nil
+}
+
+func (hl *hubListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+// tunnelAddr 监听器地址，通道会断开重连，没有固定的 socket 地址。
+type tunnelAddr struct{}
+
+func (tunnelAddr) Network() string { return "tunnel" }
+func (tunnelAddr) String() string  { return "broker" }
+
+// sessionPump 接收一个会话中 broker 发起的流并投递到 streamHub。
+//
+// 关闭 sessionPump 只是停止接收 broker 发起的新流，不会断开底层会话，
+// 已经建立的流可以继续完成，这是优雅关闭的前提。
+type sessionPump struct {
+	sess *smux.Session
+	hub  *streamHub
+	seq  uint64
+	addr *Address
+	done chan struct{}
+	once sync.Once
+	exit chan struct{} // pump 协程退出时关闭
+	err  error         // 会话断开的原因
+}
+
+func newSessionPump(sess *smux.Session, hub *streamHub, seq uint64, addr *Address) *sessionPump {
+	sp := &sessionPump{
+		sess: sess,
+		hub:  hub,
+		seq:  seq,
+		addr: addr,
+		done: make(chan struct{}),
+		exit: make(chan struct{}),
+	}
+	go sp.pump()
+
+	return sp
+}
+
+// Close 停止接收新的流，不会断开底层会话。
+func (sp *sessionPump) Close() error {
+	sp.once.Do(func() { close(sp.done) })
+	return nil
+}
+
+// cause 等待会话断开并返回断开的原因。
+func (sp *sessionPump) cause() error {
+	<-sp.exit
+	return sp.err
+}
+
+func (sp *sessionPump) pump() {
+	defer close(sp.exit)
+	for {
+		stream, err := sp.sess.AcceptStream()
+		if err != nil {
+			sp.err = err
+			return
+		}
+
+		conn := &BrokerConn{
+			Conn: stream,
+			meta: StreamMeta{
+				ID:       stream.ID(),
+				Session:  sp.seq,
+				Broker:   sp.addr,
+				Accepted: time.Now(),
+			},
+		}
+		select {
+		case sp.hub.accept <- conn:
+		case <-sp.done: // 已停止接收，拒绝新的流
+			_ = stream.Close()
+		case <-sp.hub.done:
+			_ = stream.Close()
+		case <-sp.sess.CloseChan(): // 没有人接收时会话断开
+			_ = stream.Close()
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// http2Preface HTTP/2 prior-knowledge 连接的前导数据（RFC 9113 3.4）。
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// prefaceMagic 命名流前导数据的首字节，HTTP/1.x 与 HTTP/2 的首字节都不可能是 0x00。
+const prefaceMagic = 0x00
+
+// WritePreface 写入命名流的前导数据，broker 在打开流之后、发送业务数据之前调用，
+// agent 端的 Mux 会根据 name 将流交给 Handle 注册的服务。
+//
+// 前导数据格式为：0x00 | len(name) | name，name 长度为 1-255 字节。
+func WritePreface(w io.Writer, name string) error {
+	if size := len(name); size == 0 || size > 255 {
+		return errors.New("前导名称长度必须在 1-255 之间")
+	}
+	buf := make([]byte, 0, len(name)+2)
+	buf = append(buf, prefaceMagic, byte(len(name)))
+	buf = append(buf, name...)
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// Mux 按照流的前导数据将 broker 发起的流分发给不同的服务，使一个通道可以同时承载
+// HTTP 与非 HTTP 协议，Mux 本身实现了 Server，可以直接传给 Dial：
+//
+//   - 以 WritePreface 写入的命名前导开头的流，交给 Handle/HandleFunc 注册的服务，
+//     前导数据会被消费掉，服务读到的是前导之后的数据。
+//   - 以 HTTP/2 prior-knowledge 前导开头的流，交给 HandleHTTP2 注册的服务（如 gRPC），
+//     前导数据不会被消费。
+//   - 其它的流（HTTP/1.x、未注册的命名前导、PrefaceTimeout 内未收到任何数据）
+//     原样交给默认服务。
+//
+// 各个服务收到的连接依然是 *BrokerConn，可以获取流的元数据。
+type Mux struct {
+	// PrefaceTimeout 等待前导数据的超时时间，超时后交给默认服务，默认 3s。
+	PrefaceTimeout time.Duration
+
+	def    *muxRoute
+	h2     *muxRoute
+	named  map[string]*muxRoute
+	mutex  sync.Mutex
+	served bool
+	closed bool
+}
+
+// NewMux 创建流分发器，def 为默认服务，为 nil 时直接关闭无法分发的流。
+func NewMux(def Server) *Mux {
+	m := &Mux{named: make(map[string]*muxRoute, 8)}
+	if def != nil {
+		m.def = newMuxRoute(def)
+	}
+
+	return m
+}
+
+// HandleHTTP2 注册处理 HTTP/2 prior-knowledge 流的服务，例如 grpc.Server。
+func (m *Mux) HandleHTTP2(srv Server) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.h2 = m.register(m.h2, srv)
+}
+
+// Handle 注册处理命名流的服务，name 与 broker 端 WritePreface 的参数一致。
+func (m *Mux) Handle(name string, srv Server) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.named[name] = m.register(m.named[name], srv)
+}
+
+// HandleFunc 注册处理命名流的函数，每个流都会在单独的协程中调用 fn，
+// fn 返回后不会自动关闭连接。
+func (m *Mux) HandleFunc(name string, fn func(net.Conn)) {
+	m.Handle(name, connHandler(fn))
+}
+
+// Serve 接收 ln 中的流并分发，ln 关闭后返回。
+func (m *Mux) Serve(ln net.Listener) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return net.ErrClosed
+	}
+	m.served = true
+	for _, route := range m.routes() {
+		route.start()
+	}
+	m.mutex.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go m.dispatch(conn)
+	}
+}
+
+// Shutdown 优雅关闭所有注册的服务，规则同 Server。
+func (m *Mux) Shutdown(ctx context.Context) error {
+	routes := m.stop()
+
+	var errs []error
+	for _, route := range routes {
+		if err := shutdownServer(ctx, route.srv); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close 立即关闭所有注册的服务。
+func (m *Mux) Close() error {
+	routes := m.stop()
+
+	var errs []error
+	for _, route := range routes {
+		if c, ok := route.srv.(interface{ Close() error }); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *Mux) stop() []*muxRoute {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+	routes := m.routes()
+	for _, route := range routes {
+		_ = route.ln.Close()
+	}
+
+	return routes
+}
+
+// register 注册服务，如果已经开始分发则立即启动，旧的服务会被关闭。
+func (m *Mux) register(old *muxRoute, srv Server) *muxRoute {
+	if old != nil {
+		_ = old.ln.Close()
+	}
+	route := newMuxRoute(srv)
+	if m.served && !m.closed {
+		route.start()
+	}
+
+	return route
+}
+
+func (m *Mux) routes() []*muxRoute {
+	routes := make([]*muxRoute, 0, len(m.named)+2)
+	if m.def != nil {
+		routes = append(routes, m.def)
+	}
+	if m.h2 != nil {
+		routes = append(routes, m.h2)
+	}
+	for _, route := range m.named {
+		routes = append(routes, route)
+	}
+
+	return routes
+}
+
+func (m *Mux) dispatch(conn net.Conn) {
+	timeout := m.PrefaceTimeout
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	rd := bufio.NewReaderSize(conn, 512)
+	route := m.sniff(rd)
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if route == nil {
+		_ = conn.Close()
+		return
+	}
+
+	pc := &prefacedConn{Conn: conn, rd: rd}
+	var wrapped net.Conn = pc
+	if bc, ok := conn.(*BrokerConn); ok {
+		wrapped = &BrokerConn{Conn: pc, meta: bc.meta}
+	}
+	if !route.ln.deliver(wrapped) {
+		_ = conn.Close()
+	}
+}
+
+// sniff 根据前导数据选择服务。
+func (m *Mux) sniff(rd *bufio.Reader) *muxRoute {
+	m.mutex.Lock()
+	def, h2 := m.def, m.h2
+	m.mutex.Unlock()
+
+	head, err := rd.Peek(1)
+	if err != nil {
+		return def
+	}
+
+	switch head[0] {
+	case prefaceMagic:
+		head, err = rd.Peek(2)
+		if err != nil {
+			return def
+		}
+		size := int(head[1])
+		if head, err = rd.Peek(2 + size); err != nil {
+			return def
+		}
+		m.mutex.Lock()
+		route := m.named[string(head[2:])]
+		m.mutex.Unlock()
+		if route == nil {
+			return def
+		}
+		_, _ = rd.Discard(2 + size)
+		return route
+	case http2Preface[0]:
+		if h2 == nil {
+			return def
+		}
+		// 逐字节比较，HTTP/1.x 的 POST、PUT、PATCH 请求也是以 P 开头的，
+		// 不能一次性读取完整的前导长度，否则短请求会一直等待到超时。
+		for i := 2; i <= len(http2Preface); i++ {
+			if head, err = rd.Peek(i); err != nil || head[i-1] != http2Preface[i-1] {
+				return def
+			}
+		}
+		return h2
+	default:
+		return def
+	}
+}
+
+// muxRoute 一个注册的服务及其监听器。
+type muxRoute struct {
+	srv  Server
+	ln   *chanListener
+	once sync.Once
+}
+
+func newMuxRoute(srv Server) *muxRoute {
+	return &muxRoute{srv: srv, ln: newChanListener()}
+}
+
+func (mr *muxRoute) start() {
+	mr.once.Do(func() { go func() { _ = mr.srv.Serve(mr.ln) }() })
+}
+
+// chanListener 由 Mux 投递连接的监听器。
+type chanListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newChanListener() *chanListener {
+	return &chanListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (cl *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-cl.conns:
+		return conn, nil
+	case <-cl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (cl *chanListener) Close() error {
+	cl.once.Do(func() { close(cl.done) })
+	return nil
+}
+
+func (cl *chanListener) Addr() net.Addr {
+	return tunnelAddr{}
+}
+
+// deliver 投递连接，监听器已关闭则返回 false。
+func (cl *chanListener) deliver(conn net.Conn) bool {
+	select {
+	case cl.conns <- conn:
+		return true
+	case <-cl.done:
+		return false
+	}
+}
+
+// prefacedConn 先读取已经嗅探缓冲的数据。
+type prefacedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (pc *prefacedConn) Read(p []byte) (int, error) {
+	return pc.rd.Read(p)
+}
+
+// connHandler 将处理函数包装为 Server。
+type connHandler func(net.Conn)
+
+func (fn connHandler) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go fn(conn)
+	}
+}
@@ -0,0 +1,82 @@
+package tunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMux(t *testing.T) {
+	def := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("http"))
+	})}
+	mux := NewMux(def)
+	mux.PrefaceTimeout = 100 * time.Millisecond
+	mux.HandleFunc("shell", func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	})
+	mux.HandleHTTP2(connHandler(func(conn net.Conn) {
+		buf := make([]byte, len(http2Preface))
+		_, _ = io.ReadFull(conn, buf)
+		_, _ = conn.Write([]byte("h2:" + string(buf[:3])))
+		_ = conn.Close()
+	}))
+
+	ln := newChanListener()
+	defer ln.Close()
+	go func() { _ = mux.Serve(ln) }()
+	defer mux.Close()
+
+	open := func() net.Conn {
+		cli, srv := net.Pipe()
+		ln.deliver(&BrokerConn{Conn: srv})
+		return cli
+	}
+	get := func(conn net.Conn) string {
+		_, _ = conn.Write([]byte("GET / HTTP/1.1\r\nHost: agent\r\n\r\n"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err.Error()
+		}
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4))
+		return string(body)
+	}
+
+	conn := open()
+	if err := WritePreface(conn, "shell"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("命名流分发错误：%q %v", buf, err)
+	}
+	_ = conn.Close()
+
+	conn = open()
+	_, _ = conn.Write([]byte(http2Preface))
+	reply, _ := io.ReadAll(conn)
+	if string(reply) != "h2:PRI" {
+		t.Fatalf("HTTP/2 流分发错误：%q", reply)
+	}
+
+	conn = open()
+	if body := get(conn); body != "http" {
+		t.Fatalf("HTTP/1.1 流分发错误：%q", body)
+	}
+	_ = conn.Close()
+
+	// 未注册的命名前导原样交给默认服务。
+	conn = open()
+	_ = WritePreface(conn, "unknown")
+	_, _ = conn.Write([]byte("\r\n\r\n"))
+	reply, _ = io.ReadAll(conn)
+	if !strings.Contains(string(reply), "400 Bad Request") {
+		t.Fatalf("未知前导没有交给默认服务：%q", reply)
+	}
+}
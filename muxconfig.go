@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/smux"
+)
+
+// MuxConfig 通道流复用（smux）参数，零值字段使用默认值，每次重连都会按照该参数建立会话。
+//
+// 高延迟链路可以适当调大 MaxReceiveBuffer 与 MaxStreamBuffer 以提高吞吐，
+// 内存较小的设备可以调小以减少内存占用。
+type MuxConfig struct {
+	// Version smux 协议版本，只能是 1 或 2，必须与 broker 保持一致，默认为 1。
+	// 只有版本 2 支持每个流单独的流控窗口（MaxStreamBuffer）。
+	Version int
+
+	// MaxFrameSize 发送的最大帧大小，不能超过 65535，默认 32KiB。
+	MaxFrameSize int
+
+	// MaxReceiveBuffer 整个会话的接收缓冲区大小，默认 4MiB。
+	MaxReceiveBuffer int
+
+	// MaxStreamBuffer 每个流的接收窗口大小，不能大于 MaxReceiveBuffer，默认 64KiB。
+	MaxStreamBuffer int
+
+	// KeepAliveInterval 协议层保活间隔，大于 0 时开启保活，默认关闭。
+	//
+	// 开启后每隔 KeepAliveInterval 向 broker 发送一个 NOP 帧，KeepAliveTimeout 时间内
+	// 没有收到 broker 的任何数据则认为链路已断开并重连，可以比分钟级的心跳更快地发现死链。
+	// 注意：smux 收到 NOP 帧不会回复，所以 broker 端也必须开启保活，并且其保活间隔
+	// 要小于这里的 KeepAliveTimeout，否则空闲的会话会被误判为断开。
+	KeepAliveInterval time.Duration
+
+	// KeepAliveTimeout 保活超时时间，必须大于 KeepAliveInterval，默认为 3 倍 KeepAliveInterval。
+	KeepAliveTimeout time.Duration
+}
+
+// smuxConfig 转换为 smux 参数并校验。
+func (mc MuxConfig) smuxConfig() (*smux.Config, error) {
+	cfg := smux.DefaultConfig()
+	if mc.Version != 0 {
+		cfg.Version = mc.Version
+	}
+	if mc.MaxFrameSize != 0 {
+		cfg.MaxFrameSize = mc.MaxFrameSize
+	}
+	if mc.MaxReceiveBuffer != 0 {
+		cfg.MaxReceiveBuffer = mc.MaxReceiveBuffer
+	}
+	if mc.MaxStreamBuffer != 0 {
+		cfg.MaxStreamBuffer = mc.MaxStreamBuffer
+	}
+	if du := mc.KeepAliveInterval; du > 0 {
+		cfg.KeepAliveDisabled = false
+		cfg.KeepAliveInterval = du
+		cfg.KeepAliveTimeout = mc.KeepAliveTimeout
+		if cfg.KeepAliveTimeout <= 0 {
+			cfg.KeepAliveTimeout = 3 * du
+		}
+	}
+	if err := smux.VerifyConfig(cfg); err != nil {
+		return nil, fmt.Errorf("smux 参数错误：%w", err)
+	}
+
+	return cfg, nil
+}
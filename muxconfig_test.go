@@ -0,0 +1,28 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMuxConfig(t *testing.T) {
+	cfg, err := MuxConfig{KeepAliveInterval: 5 * time.Second}.smuxConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.KeepAliveDisabled || cfg.KeepAliveTimeout != 15*time.Second {
+		t.Fatalf("保活参数错误：%+v", cfg)
+	}
+
+	invalids := []MuxConfig{
+		{Version: 3},
+		{MaxFrameSize: 70000},
+		{MaxReceiveBuffer: 1024, MaxStreamBuffer: 4096},
+		{KeepAliveInterval: time.Minute, KeepAliveTimeout: time.Second},
+	}
+	for _, mc := range invalids {
+		if _, err = mc.smuxConfig(); err == nil {
+			t.Errorf("参数 %+v 应当校验失败", mc)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package tunnel
 
 // Notifier 通道 掉线/重连成功/关闭 事件通知器
+//
+// 回调在通道内部的协程中同步调用，回调中可以调用 Tunneler.Close 或 Tunneler.Shutdown，
+// 此时不会等待通道内部的协程退出。
 type Notifier interface {
 	// Connected 首次连接成功的回调函数
 	Connected(addr *Address)
@@ -12,6 +15,7 @@ type Notifier interface {
 	Reconnected(addr *Address)
 
 	// Shutdown 连接遇到不可重试的错误，通道关闭程序结束。
+	// 主动调用 Close/Shutdown 时 err 为 ErrTunnelClosed，取消 Dial 传入的 context 时为 ctx.Err()。
 	Shutdown(err error)
 }
 
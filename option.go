@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"io"
 	"time"
@@ -11,11 +12,23 @@ type Option func(*option)
 
 // option 参数
 type option struct {
-	coder    Coder         // json 编解码器
-	slog     Logger        // 日志输出组件
-	ntf      Notifier      // 通道连接事件通知
-	ident    Identifier    // 机器码生成器
-	interval time.Duration // 心跳包发送间隔
+	coder    Coder            // json 编解码器
+	slog     Logger           // 日志输出组件
+	ntf      Notifier         // 通道连接事件通知
+	ident    Identifier       // 机器码生成器
+	interval time.Duration    // 心跳包发送间隔
+	probe    time.Duration    // 心跳失败后快速探测的初始间隔
+	payload  HeartbeatPayload // 心跳报文提供者
+	backoff  Backoff          // 重连退避策略
+	stable   time.Duration    // 连接保持该时长后重置退避策略
+	wait     time.Duration    // 通道未连接时 DialContext 的最长等待时长
+	selector Selector         // broker 地址选择策略
+	race     time.Duration    // 并行竞速连接的错开间隔，0 代表逐个连接
+	tls      tlsPolicies      // TLS 连接策略
+	tlsOnly  bool             // 禁止明文连接
+	proxy    ProxyFunc        // 出站代理
+	mux      MuxConfig        // smux 参数
+	outbox   *OutboxConfig    // 离线上报队列参数
 }
 
 // WithLogger 设置日志输出组件
@@ -27,13 +40,172 @@ func WithLogger(slog Logger) Option {
 
 // WithInterval 设置心跳包间隔，如果不设置或该时间小于等于 0 则代表不发送心跳包。
 // 心跳只是一种异常断开的兜底机制，由于生产环境节点较多，心跳间隔设置的太短也会给
-// 中心端增加处理压力。
+// 中心端增加处理压力。运行期间可以通过 Heartbeat().SetInterval 调整心跳间隔。
 func WithInterval(interval time.Duration) Option {
 	return func(opt *option) {
 		opt.interval = interval
 	}
 }
 
+// WithHeartbeatProbe 心跳失败后不再等待完整的心跳间隔，而是在 du 后快速探测，
+// 之后每次失败探测间隔翻倍（不超过心跳间隔），心跳成功后恢复正常间隔。
+// 默认不开启快速探测。由于心跳连续失败 5 次会主动断开连接，开启后能更快地发现失效的连接。
+func WithHeartbeatProbe(du time.Duration) Option {
+	return func(opt *option) {
+		opt.probe = du
+	}
+}
+
+// WithHeartbeatPayload 设置心跳报文提供者，每次发送心跳时调用，返回值使用 Coder 编码后
+// 作为心跳报文发送，中心端无需单独的采集接口即可获取节点近实时的运行状态。例如：
+//
+//	tunnel.WithHeartbeatPayload(func(ctx context.Context, snap tunnel.HealthSnapshot) any {
+//		snap.Checks = map[string]string{"db": "ok"}
+//		return snap
+//	})
+//
+// 默认心跳不携带报文。
+func WithHeartbeatPayload(payload HeartbeatPayload) Option {
+	return func(opt *option) {
+		opt.payload = payload
+	}
+}
+
+// WithBackoff 设置重连退避策略，默认为 NewLadderBackoff。
+// 节点数量较多时建议使用带抖动的退避策略，避免 broker 重启后大量节点同时重连。
+func WithBackoff(backoff Backoff) Option {
+	return func(opt *option) {
+		opt.backoff = backoff
+	}
+}
+
+// WithBackoffReset 连接稳定保持 du 时长后重置退避策略，默认为 1min。
+// 连接成功后如果很快又断开，说明链路不稳定，此时不会重置退避状态，
+// 重试间隔会按照退避策略继续增长。
+func WithBackoffReset(du time.Duration) Option {
+	return func(opt *option) {
+		opt.stable = du
+	}
+}
+
+// WithDialWait 通道未连接（首次连接中或断线重连中）时，DialContext 最多等待
+// du 时长直至连接成功，同时受 DialContext 传入的 ctx 约束。
+// du 小于等于 0 时代表不等待，立即返回 ErrDisconnected（fail fast）。
+//
+// Dial 默认不等待，DialAsync 默认一直等待直至 ctx 结束。
+func WithDialWait(du time.Duration) Option {
+	return func(opt *option) {
+		opt.wait = du
+	}
+}
+
+// WithSelector 设置 broker 地址选择策略，默认为 NewRoundRobinSelector。
+func WithSelector(sel Selector) Option {
+	return func(opt *option) {
+		opt.selector = sel
+	}
+}
+
+// WithHappyEyeballs 开启并行竞速连接（参考 RFC 8305 Happy Eyeballs）。
+//
+// 默认情况下每次只连接一个 broker 地址，地址不可达时要等待连接超时才会尝试下一个。
+// 开启后会将每个地址解析出的 IPv6/IPv4 地址交替排列，每隔 delay 并行发起一个新的连接，
+// 上一个连接失败时立即发起下一个，第一个连接成功的地址胜出，其余连接会被取消。
+// Selector 选出的地址总是最先发起连接，但同一主机的明文连接只会在其 TLS 连接全部失败后发起，
+// 不会因为省去了 TLS 握手而抢先胜出。delay 小于等于 0 时默认为 250ms。
+func WithHappyEyeballs(delay time.Duration) Option {
+	return func(opt *option) {
+		if delay <= 0 {
+			delay = 250 * time.Millisecond
+		}
+		opt.race = delay
+	}
+}
+
+// WithTLSConfig 设置连接 broker 的 TLS 配置，例如私有 CA、客户端证书（mTLS）、最低 TLS 版本。
+//
+// cfg 在每次连接时都会被复制，ServerName 为空时自动填充。设置了 RootCAs 后只信任其中的 CA，
+// 不会再信任系统根证书。如果要求必须使用 TLS 连接，请同时设置 WithTLSOnly。
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(opt *option) {
+		opt.tls.global.Config = cfg
+	}
+}
+
+// WithTLSPins 设置 broker 证书的公钥指纹（见 PinSHA256），证书链中至少有一个证书的公钥
+// 与之匹配才允许连接。
+func WithTLSPins(pins ...string) Option {
+	return func(opt *option) {
+		opt.tls.global.Pins = append(opt.tls.global.Pins, pins...)
+	}
+}
+
+// WithTLSVerify 自定义 TLS 连接校验，在证书链与公钥指纹校验通过后调用。
+func WithTLSVerify(verify func(cs tls.ConnectionState, addr *Address) error) Option {
+	return func(opt *option) {
+		opt.tls.global.Verify = verify
+	}
+}
+
+// WithAddressTLS 为某个 broker 地址单独设置 TLS 策略，addr 可以是 host:port 或 host，
+// 与 definition.MHide 的 Addrs 中填写的地址一致。匹配到的地址完全使用 policy，
+// 不会再使用 WithTLSConfig、WithTLSPins、WithTLSVerify 设置的全局策略。
+func WithAddressTLS(addr string, policy TLSPolicy) Option {
+	return func(opt *option) {
+		if opt.tls.addrs == nil {
+			opt.tls.addrs = make(map[string]TLSPolicy, 4)
+		}
+		opt.tls.addrs[addr] = policy
+	}
+}
+
+// WithTLSOnly 只使用 TLS 连接 broker，默认情况下 TLS 连接失败后会尝试明文连接。
+func WithTLSOnly() Option {
+	return func(opt *option) {
+		opt.tlsOnly = true
+	}
+}
+
+// WithProxy 设置连接 broker 所使用的出站代理，支持 HTTP CONNECT（含 Basic 认证）与 SOCKS5，
+// 例如：
+//
+//	tunnel.WithProxy(tunnel.ProxyURL(&url.URL{Scheme: "http", Host: "proxy:3128", User: url.UserPassword("u", "p")}))
+//	tunnel.WithProxy(tunnel.ProxyFromEnvironment) // 使用 HTTPS_PROXY/HTTP_PROXY/NO_PROXY 环境变量
+//
+// 经过代理的连接，上报给 Notifier 与日志输出的 Address.Proxy 为代理地址（已隐藏密码）。
+// definition.MHide 中目前没有代理配置字段，需要由调用方读取配置后通过该选项设置。
+func WithProxy(proxy ProxyFunc) Option {
+	return func(opt *option) {
+		opt.proxy = proxy
+	}
+}
+
+// WithMuxConfig 设置通道流复用（smux）参数，参数会在 Dial/DialAsync 时校验，
+// 校验不通过会直接返回错误。
+func WithMuxConfig(cfg MuxConfig) Option {
+	return func(opt *option) {
+		opt.mux = cfg
+	}
+}
+
+// WithOutbox 开启离线上报队列，通道断开期间 Oneway 与 OnewayJSON 的上报会写入磁盘，
+// 重连成功后按照优先级与入队顺序重放，此时这两个方法入队成功即返回 nil。例如：
+//
+//	tunnel.WithOutbox(tunnel.OutboxConfig{
+//		Dir: "/var/lib/ssoc/outbox",
+//		Policies: map[string]tunnel.OutboxPolicy{
+//			"/api/v1/broker/audit/event":           {Priority: 10},
+//			"/api/v1/broker/collect/agent/process": {Dedupe: true},
+//		},
+//	})
+//
+// 队列目录打开失败时 Dial/DialAsync 会直接返回错误。
+func WithOutbox(cfg OutboxConfig) Option {
+	return func(opt *option) {
+		opt.outbox = &cfg
+	}
+}
+
 // WithCoder 自定义 json 编解码器
 func WithCoder(coder Coder) Option {
 	return func(opt *option) {
@@ -0,0 +1,448 @@
+package tunnel
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutboxConfig 离线上报队列参数，见 WithOutbox。
+type OutboxConfig struct {
+	// Dir 队列文件所在目录，不能为空。
+	Dir string
+
+	// MaxBytes 队列文件最多占用的磁盘空间（包含删除标记），超出后丢弃最旧的上报，默认 64MiB。
+	MaxBytes int64
+
+	// MaxAge 上报在队列中的最长保留时间，过期后丢弃，默认 24h。
+	MaxAge time.Duration
+
+	// Policies 按照请求路径（不含查询参数）设置的入队策略，未设置的路径使用零值策略。
+	Policies map[string]OutboxPolicy
+}
+
+// OutboxPolicy 某个路径的入队策略。
+type OutboxPolicy struct {
+	// Priority 重放优先级，值越大越先重放，相同优先级按照入队顺序重放。
+	Priority int
+
+	// Dedupe 只保留该路径最新的一次上报，适用于全量快照类的上报（如进程列表），
+	// 新的上报入队时会移除该路径之前未发送的上报，被替换的上报不计入 OutboxStats.Dropped。
+	Dedupe bool
+}
+
+// OutboxStats 队列的监控数据。
+type OutboxStats struct {
+	Depth   int       `json:"depth"`   // 队列中待发送的上报数
+	Bytes   int64     `json:"bytes"`   // 队列中待发送的上报占用的磁盘空间
+	Dropped int64     `json:"dropped"` // 因为容量或过期而丢弃的上报数
+	Oldest  time.Time `json:"oldest"`  // 最早入队的上报时间，队列为空时为零值
+}
+
+// ErrOutboxFull 单个上报超过了队列的容量。
+var ErrOutboxFull = errors.New("上报超过了离线队列的容量")
+
+// Outbox 离线上报队列。
+//
+// 通道断开期间 Oneway 与 OnewayJSON 的上报会写入磁盘上的队列，重连成功后按照
+// 优先级与入队顺序重放。队列是一个追加写的日志文件，每条记录都有 CRC 校验，
+// 进程重启后会读取未发送的上报，末尾不完整的记录会被截断。
+//
+// 没有使用固定大小的环形缓冲区：上报的大小不一，并且按优先级重放、按路径去重时
+// 删除的并不总是最旧的记录，环形缓冲区会产生无法复用的空洞。日志文件中已删除的记录
+// 通过删除标记表示，占用过多空间或文件将超出 MaxBytes 时重写文件回收空间。
+//
+// 上报入队时会同步落盘，删除标记则不会，进程崩溃或断电后已经发送的上报可能会被再次发送，
+// 即离线上报保证至少一次送达，broker 需要容忍重复的上报。
+type Outbox struct {
+	cfg     OutboxConfig
+	name    string
+	mutex   sync.Mutex
+	file    *os.File
+	end     int64 // 文件末尾偏移
+	live    int64 // 待发送的上报占用的空间
+	seq     uint64
+	items   map[uint64]*outboxItem
+	dropped int64
+}
+
+type outboxItem struct {
+	seq      uint64
+	path     string
+	priority int
+	at       time.Time
+	off      int64
+	size     int64
+}
+
+// outboxRecord 队列文件中的一条记录。
+type outboxRecord struct {
+	Seq      uint64      `json:"seq"`
+	Del      bool        `json:"del,omitempty"` // 删除标记
+	Path     string      `json:"path,omitempty"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     []byte      `json:"body,omitempty"`
+	Priority int         `json:"priority,omitempty"`
+	At       time.Time   `json:"at"`
+}
+
+// outboxHeadSize 记录头：4 字节长度 + 4 字节 CRC32。
+const outboxHeadSize = 8
+
+// OpenOutbox 打开（不存在则创建）离线上报队列。
+func OpenOutbox(cfg OutboxConfig) (*Outbox, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("离线队列目录不能为空")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 64 << 20
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 24 * time.Hour
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	name := filepath.Join(cfg.Dir, "outbox.log")
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	ob := &Outbox{cfg: cfg, name: name, file: file, items: make(map[uint64]*outboxItem, 64)}
+	if err = ob.load(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return ob, nil
+}
+
+// Stats 队列的监控数据，队列为 nil 时返回零值。
+func (ob *Outbox) Stats() OutboxStats {
+	if ob == nil {
+		return OutboxStats{}
+	}
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	stats := OutboxStats{Depth: len(ob.items), Bytes: ob.live, Dropped: ob.dropped}
+	for _, it := range ob.items {
+		if stats.Oldest.IsZero() || it.at.Before(stats.Oldest) {
+			stats.Oldest = it.at
+		}
+	}
+
+	return stats
+}
+
+// Len 队列中待发送的上报数，队列为 nil 时返回 0。
+func (ob *Outbox) Len() int {
+	if ob == nil {
+		return 0
+	}
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return len(ob.items)
+}
+
+// Close 关闭队列文件，未发送的上报会在下次打开时继续发送。
+func (ob *Outbox) Close() error {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	return ob.file.Close()
+}
+
+// push 上报入队。
+func (ob *Outbox) push(path string, header http.Header, body []byte) error {
+	key, _, _ := strings.Cut(path, "?")
+	policy := ob.cfg.Policies[key]
+
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.seq++
+	rec := &outboxRecord{Seq: ob.seq, Path: path, Header: header, Body: body, Priority: policy.Priority, At: time.Now()}
+	raw, err := encodeOutboxRecord(rec)
+	if err != nil {
+		return err
+	}
+	size := int64(len(raw))
+	if size > ob.cfg.MaxBytes {
+		return ErrOutboxFull
+	}
+
+	if policy.Dedupe {
+		for _, it := range ob.items {
+			if sk, _, _ := strings.Cut(it.path, "?"); sk == key {
+				ob.delete(it)
+			}
+		}
+	}
+	ob.expire()
+	for ob.live+size > ob.cfg.MaxBytes && len(ob.items) != 0 {
+		ob.drop(ob.oldest())
+	}
+	if ob.end+size > ob.cfg.MaxBytes { // 删除标记占用的空间也计入容量
+		if err = ob.rewrite(); err != nil {
+			return err
+		}
+	}
+
+	off := ob.end
+	if _, err = ob.file.WriteAt(raw, off); err != nil {
+		return err
+	}
+	if err = ob.file.Sync(); err != nil {
+		return err
+	}
+	ob.end += size
+	ob.live += size
+	ob.items[rec.Seq] = &outboxItem{seq: rec.Seq, path: path, priority: rec.Priority, at: rec.At, off: off, size: size}
+
+	return nil
+}
+
+// pending 待发送的上报，按照优先级从高到低、入队顺序排列。
+func (ob *Outbox) pending() []*outboxItem {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	ob.expire()
+	items := make([]*outboxItem, 0, len(ob.items))
+	for _, it := range ob.items {
+		items = append(items, it)
+	}
+	slices.SortFunc(items, func(a, b *outboxItem) int {
+		if a.priority != b.priority {
+			return cmp.Compare(b.priority, a.priority)
+		}
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	return items
+}
+
+// read 读取上报内容，上报已经被移除时返回 nil。
+func (ob *Outbox) read(it *outboxItem) (*outboxRecord, error) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if ob.items[it.seq] != it {
+		return nil, nil
+	}
+	raw := make([]byte, it.size)
+	if _, err := ob.file.ReadAt(raw, it.off); err != nil {
+		return nil, err
+	}
+	rec := new(outboxRecord)
+	if err := json.Unmarshal(raw[outboxHeadSize:], rec); err != nil {
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// remove 上报发送完毕（或被 broker 拒绝）后移出队列。
+func (ob *Outbox) remove(it *outboxItem) {
+	ob.mutex.Lock()
+	defer ob.mutex.Unlock()
+
+	if ob.items[it.seq] == it {
+		ob.delete(it)
+		ob.compact()
+	}
+}
+
+// load 读取队列文件，重建索引。
+func (ob *Outbox) load() error {
+	rd := bufio.NewReader(ob.file)
+	head := make([]byte, outboxHeadSize)
+	var off int64
+	for {
+		if _, err := io.ReadFull(rd, head); err != nil {
+			break
+		}
+		size := binary.BigEndian.Uint32(head)
+		raw := make([]byte, size)
+		if _, err := io.ReadFull(rd, raw); err != nil || crc32.ChecksumIEEE(raw) != binary.BigEndian.Uint32(head[4:]) {
+			break
+		}
+		rec := new(outboxRecord)
+		if err := json.Unmarshal(raw, rec); err != nil {
+			break
+		}
+
+		total := int64(outboxHeadSize) + int64(size)
+		ob.seq = max(ob.seq, rec.Seq)
+		if rec.Del {
+			if it := ob.items[rec.Seq]; it != nil {
+				ob.live -= it.size
+				delete(ob.items, rec.Seq)
+			}
+		} else {
+			ob.items[rec.Seq] = &outboxItem{seq: rec.Seq, path: rec.Path, priority: rec.Priority, at: rec.At, off: off, size: total}
+			ob.live += total
+		}
+		off += total
+	}
+
+	// 截断末尾不完整的记录（写入过程中进程退出或断电）
+	if err := ob.file.Truncate(off); err != nil {
+		return err
+	}
+	ob.end = off
+	if len(ob.items) == 0 && ob.end != 0 {
+		if err := ob.file.Truncate(0); err != nil {
+			return err
+		}
+		ob.end = 0
+	}
+	ob.expire()
+	ob.compact()
+
+	return nil
+}
+
+// expire 丢弃过期的上报，调用方需持有锁。
+func (ob *Outbox) expire() {
+	deadline := time.Now().Add(-ob.cfg.MaxAge)
+	for _, it := range ob.items {
+		if it.at.Before(deadline) {
+			ob.drop(it)
+		}
+	}
+}
+
+// oldest 最早入队的上报，调用方需持有锁。
+func (ob *Outbox) oldest() *outboxItem {
+	var old *outboxItem
+	for _, it := range ob.items {
+		if old == nil || it.seq < old.seq {
+			old = it
+		}
+	}
+
+	return old
+}
+
+// drop 丢弃未发送的上报，调用方需持有锁。
+func (ob *Outbox) drop(it *outboxItem) {
+	ob.dropped++
+	ob.delete(it)
+}
+
+// delete 写入删除标记，调用方需持有锁。
+func (ob *Outbox) delete(it *outboxItem) {
+	delete(ob.items, it.seq)
+	ob.live -= it.size
+	if len(ob.items) == 0 { // 队列已空，直接清空文件
+		if ob.file.Truncate(0) == nil {
+			ob.end = 0
+		}
+		return
+	}
+
+	raw, err := encodeOutboxRecord(&outboxRecord{Seq: it.seq, Del: true})
+	if err != nil {
+		return
+	}
+	if ob.end+int64(len(raw)) > ob.cfg.MaxBytes { // 写入删除标记会超出容量，直接重写文件
+		_ = ob.rewrite()
+		return
+	}
+	if _, err = ob.file.WriteAt(raw, ob.end); err == nil {
+		ob.end += int64(len(raw))
+	}
+}
+
+// compact 已删除的记录占用过多空间时重写文件，调用方需持有锁。
+func (ob *Outbox) compact() {
+	if ob.end < 1<<20 || ob.end < 2*ob.live {
+		return
+	}
+	_ = ob.rewrite()
+}
+
+// rewrite 将未发送的上报重写到新文件并替换队列文件，调用方需持有锁。
+//
+// Windows 不能重命名覆盖已经打开的文件，所以先关闭队列文件再替换，之后重新打开。
+func (ob *Outbox) rewrite() error {
+	tmp := ob.name + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	items := make([]*outboxItem, 0, len(ob.items))
+	for _, it := range ob.items {
+		items = append(items, it)
+	}
+	slices.SortFunc(items, func(a, b *outboxItem) int { return cmp.Compare(a.seq, b.seq) })
+
+	offsets := make([]int64, len(items))
+	var off int64
+	for i, it := range items {
+		raw := make([]byte, it.size)
+		if _, err = ob.file.ReadAt(raw, it.off); err == nil {
+			_, err = file.WriteAt(raw, off)
+		}
+		if err != nil {
+			break
+		}
+		offsets[i] = off
+		off += it.size
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if exx := file.Close(); err == nil {
+		err = exx
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	_ = ob.file.Close()
+	renamed := os.Rename(tmp, ob.name)
+	if ob.file, err = os.OpenFile(ob.name, os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+		return err
+	}
+	if renamed != nil { // 替换失败，继续使用原来的文件
+		_ = os.Remove(tmp)
+		return renamed
+	}
+	ob.end = off
+	for i, it := range items {
+		it.off = offsets[i]
+	}
+
+	return nil
+}
+
+func encodeOutboxRecord(rec *outboxRecord) ([]byte, error) {
+	dat, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, outboxHeadSize, outboxHeadSize+len(dat))
+	binary.BigEndian.PutUint32(raw, uint32(len(dat)))
+	binary.BigEndian.PutUint32(raw[4:], crc32.ChecksumIEEE(dat))
+
+	return append(raw, dat...), nil
+}
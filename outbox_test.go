@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOutbox(t *testing.T) {
+	dir := t.TempDir()
+	cfg := OutboxConfig{
+		Dir: dir,
+		Policies: map[string]OutboxPolicy{
+			"/audit":   {Priority: 10},
+			"/process": {Dedupe: true},
+		},
+	}
+	ob, err := OpenOutbox(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/a", "/process", "/audit", "/process?full=1", "/b"} {
+		if err = ob.push(path, nil, []byte(path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := ob.Stats(); st.Depth != 4 || st.Dropped != 0 {
+		t.Fatalf("队列统计错误：%+v", st)
+	}
+	_ = ob.Close()
+
+	// 重新打开后依然保留未发送的上报，并按照优先级与入队顺序排列。
+	if ob, err = OpenOutbox(cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/audit", "/a", "/process?full=1", "/b"}
+	items := ob.pending()
+	if len(items) != len(want) {
+		t.Fatalf("期望 %d 个上报，实际 %d 个", len(want), len(items))
+	}
+	for i, it := range items {
+		rec, exx := ob.read(it)
+		if exx != nil || rec.Path != want[i] || string(rec.Body) != want[i] {
+			t.Fatalf("第 %d 个上报错误：%+v %v", i, rec, exx)
+		}
+	}
+	ob.remove(items[0])
+	_ = ob.Close()
+
+	// 末尾写入不完整的记录会被截断。
+	name := filepath.Join(dir, "outbox.log")
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.Write([]byte{0, 0, 1, 0, 1, 2})
+	_ = file.Close()
+	if ob, err = OpenOutbox(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := ob.Len(); n != 3 {
+		t.Fatalf("期望 3 个上报，实际 %d 个", n)
+	}
+	for _, it := range ob.pending() {
+		ob.remove(it)
+	}
+	if info, _ := os.Stat(name); info.Size() != 0 {
+		t.Fatalf("队列为空时文件应被清空，实际大小 %d", info.Size())
+	}
+	_ = ob.Close()
+}
+
+func TestOutboxLimit(t *testing.T) {
+	ob, err := OpenOutbox(OutboxConfig{Dir: t.TempDir(), MaxBytes: 1024, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ob.Close()
+
+	// 文件大小（包含删除标记）始终不超过容量。
+	body := make([]byte, 300)
+	name := filepath.Join(ob.cfg.Dir, "outbox.log")
+	for i := 0; i < 20; i++ {
+		if err = ob.push("/report", nil, body); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			ob.remove(ob.pending()[0])
+		}
+		if info, _ := os.Stat(name); info.Size() > 1024 {
+			t.Fatalf("第 %d 次入队后文件超出容量：%d", i, info.Size())
+		}
+	}
+	if st := ob.Stats(); st.Bytes > 1024 || st.Dropped == 0 {
+		t.Fatalf("超出容量时应丢弃最旧的上报：%+v", st)
+	}
+	if n := ob.Len(); n == 0 {
+		t.Fatal("重写文件后上报不应丢失")
+	}
+	for _, it := range ob.pending() {
+		if rec, exx := ob.read(it); exx != nil || len(rec.Body) != 300 {
+			t.Fatalf("重写文件后读取上报错误：%v", exx)
+		}
+	}
+	if err = ob.push("/report", nil, make([]byte, 2048)); err != ErrOutboxFull {
+		t.Fatalf("期望 ErrOutboxFull，实际 %v", err)
+	}
+
+	// 过期的上报被丢弃
+	ob.cfg.MaxAge = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if n := len(ob.pending()); n != 0 {
+		t.Fatalf("过期的上报应被丢弃，实际剩余 %d 个", n)
+	}
+}
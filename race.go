@@ -0,0 +1,261 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+)
+
+// raceDial 仿照 RFC 8305（Happy Eyeballs v2）并行竞速连接多个 broker 地址。
+//
+// 所有域名并发解析，同一主机的 TLS 与明文地址共用一次解析结果，收到第一个解析结果后
+// 立即开始连接，不必等待全部解析完毕。按照 Selector 选出的地址优先，
+// 将每个地址解析出的 IPv6/IPv4 地址交替排列，每隔 delay 发起一个新的连接
+// （前一个连接失败时立即发起下一个），第一个连接成功的地址胜出，其余连接全部取消。
+// 与逐个连接一样，同一主机的明文连接只会在其 TLS 连接全部失败后发起。
+type raceDial struct {
+	base     *iterDial
+	delay    time.Duration
+	resolver ipResolver
+	slog     Logger
+}
+
+// ipResolver 域名解析器，默认为 net.DefaultResolver。
+type ipResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// attempt 一次连接尝试。
+type attempt struct {
+	addr     *Address // broker 地址
+	hostport string   // 实际连接的 IP:Port
+	proxy    *url.URL // 经过的代理，nil 代表直连
+}
+
+// raceTally 一个 broker 地址的连接尝试统计。
+type raceTally struct {
+	resolving bool          // 域名正在解析
+	queue     []attempt     // 尚未发起的连接尝试
+	remain    int           // 尚未结束的连接尝试数，包括尚未发起的
+	errs      []error       // 已经失败的连接尝试的错误
+	rtt       time.Duration // 失败的连接尝试中最长的耗时
+}
+
+func (tl *raceTally) add(at attempt) {
+	tl.queue = append(tl.queue, at)
+	tl.remain++
+}
+
+type raceResult struct {
+	attempt attempt
+	conn    net.Conn
+	rtt     time.Duration
+	err     error
+}
+
+type lookupResult struct {
+	host string
+	ips  []net.IPAddr
+	err  error
+}
+
+func (rd *raceDial) iterDial(parent context.Context, timeout time.Duration) (net.Conn, *Address, error) {
+	addrs, selector := rd.base.addrs, rd.base.selector
+	first := rd.base.selectAddr(parent)
+	ordered := make(Addresses, 0, len(addrs))
+	ordered = append(ordered, first)
+	for _, addr := range addrs {
+		if addr != first {
+			ordered = append(ordered, addr)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// 每个地址的全部连接尝试结束后才向 Selector 上报结果，
+	// 避免某个 IP 不可达时该地址的其它 IP 还在连接中就被判定为失败。
+	var errs []error
+	tallies := make(map[*Address]*raceTally, len(ordered))
+	waiting := make(map[string]Addresses, len(ordered)) // 域名 -> 等待其解析结果的地址
+	lookups := make(chan lookupResult, len(ordered))
+	for _, addr := range ordered {
+		tl := new(raceTally)
+		tallies[addr] = tl
+		proxy, err := rd.base.proxyFor(addr)
+		if err != nil {
+			rd.slog.Warnf("broker 地址 %s %s", addr.Addr, err)
+			errs = append(errs, err)
+			continue
+		}
+		if proxy != nil { // 经过代理的地址交由代理解析
+			tl.add(attempt{addr: addr, hostport: addr.Addr, proxy: proxy})
+			continue
+		}
+		host, _ := splitHostPort(addr.Addr)
+		if ip := net.ParseIP(host); ip != nil {
+			tl.add(attempt{addr: addr, hostport: addr.Addr})
+			continue
+		}
+
+		tl.resolving = true
+		if _, ok := waiting[host]; !ok {
+			go rd.lookup(ctx, host, timeout, lookups)
+		}
+		waiting[host] = append(waiting[host], addr)
+	}
+	resolving := len(waiting)
+
+	// pick 选出下一个可以发起连接的地址，没有时返回 nil。
+	// 明文连接只能在同一主机的 TLS 连接全部失败后发起，否则省去了 TLS 握手的明文连接
+	// 在握手耗时超过 delay 的链路上总是胜出，相当于悄悄降级为明文。
+	pick := func() *Address {
+		for _, addr := range ordered {
+			if len(tallies[addr].queue) == 0 {
+				continue
+			}
+			if sa, ok := rd.base.tlsOf[addr]; ok {
+				if tl := tallies[sa]; tl != nil && (tl.resolving || tl.remain > 0) {
+					continue
+				}
+			}
+			return addr
+		}
+		return nil
+	}
+
+	results := make(chan raceResult, len(ordered))
+	running, launched := 0, 0
+	launch := func(addr *Address) {
+		tl := tallies[addr]
+		at := tl.queue[0]
+		tl.queue = tl.queue[1:]
+		running++
+		launched++
+		go func() {
+			actx, acancel := context.WithTimeout(ctx, timeout)
+			defer acancel()
+
+			start := time.Now()
+			conn, err := rd.base.dialAddr(actx, at.addr, at.hostport, at.proxy)
+			results <- raceResult{attempt: at, conn: conn, rtt: time.Since(start), err: err}
+		}()
+	}
+
+	timer := time.NewTimer(rd.delay)
+	defer timer.Stop()
+
+	if addr := pick(); addr != nil {
+		launch(addr)
+	}
+	for running > 0 || resolving > 0 {
+		var stagger <-chan time.Time
+		if running > 0 && pick() != nil {
+			stagger = timer.C
+		}
+
+		next := true
+		select {
+		case lr := <-lookups:
+			resolving--
+			if lr.err != nil {
+				errs = append(errs, lr.err)
+			}
+			for _, addr := range waiting[lr.host] {
+				tl := tallies[addr]
+				tl.resolving = false
+				_, port := splitHostPort(addr.Addr)
+				for _, ip := range interleave(lr.ips) {
+					tl.add(attempt{addr: addr, hostport: net.JoinHostPort(ip.String(), port)})
+				}
+			}
+			next = running == 0 // 收到第一个解析结果时立即连接，之后仍然按照 delay 错开
+		case res := <-results:
+			running--
+			addr := res.attempt.addr
+			if res.err == nil {
+				selector.Report(addr, res.rtt, nil)
+				cancel()
+				go rd.discard(results, running) // 关闭其它后到达的连接
+				return res.conn, via(addr, res.attempt.proxy), nil
+			}
+
+			errs = append(errs, res.err)
+			tl := tallies[addr]
+			tl.remain--
+			tl.errs = append(tl.errs, res.err)
+			tl.rtt = max(tl.rtt, res.rtt)
+			if tl.remain == 0 && parent.Err() == nil { // 主动取消的连接不计入连接结果
+				selector.Report(addr, tl.rtt, errors.Join(tl.errs...))
+			}
+		case <-stagger:
+		case <-parent.Done():
+			go rd.discard(results, running)
+			return nil, first, parent.Err()
+		}
+
+		// 到达错开时间或者上一个连接失败，立即发起下一个连接。
+		if addr := pick(); next && addr != nil {
+			launch(addr)
+			timer.Reset(rd.delay)
+		}
+	}
+
+	if launched == 0 && len(errs) == 0 {
+		return nil, first, errors.New("broker 地址均无法解析")
+	}
+
+	return nil, first, errors.Join(errs...)
+}
+
+// lookup 解析域名 host，结果写入 lookups。
+func (rd *raceDial) lookup(ctx context.Context, host string, timeout time.Duration, lookups chan<- lookupResult) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ips, err := rd.resolver.LookupIPAddr(ctx, host)
+	lookups <- lookupResult{host: host, ips: ips, err: err}
+}
+
+func (rd *raceDial) report(addr *Address, rtt time.Duration, err error) {
+	rd.base.report(addr, rtt, err)
+}
+
+func (rd *raceDial) lookupMAC(ip net.IP) net.HardwareAddr {
+	return rd.base.lookupMAC(ip)
+}
+
+// discard 关闭竞速失败但连接成功的连接。
+func (*raceDial) discard(results <-chan raceResult, running int) {
+	for ; running > 0; running-- {
+		if res := <-results; res.conn != nil {
+			_ = res.conn.Close()
+		}
+	}
+}
+
+// interleave 将 IPv6 与 IPv4 地址交替排列，IPv6 优先。
+func interleave(ips []net.IPAddr) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip.IP)
+		} else {
+			v6 = append(v6, ip.IP)
+		}
+	}
+
+	ret := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			ret = append(ret, v6[i])
+		}
+		if i < len(v4) {
+			ret = append(ret, v4[i])
+		}
+	}
+
+	return ret
+}
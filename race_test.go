@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// delayResolver 按照域名延迟返回 127.0.0.1，并统计每个域名的解析次数。
+type delayResolver struct {
+	delays map[string]time.Duration
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (dr *delayResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	dr.mutex.Lock()
+	dr.counts[host]++
+	dr.mutex.Unlock()
+
+	select {
+	case <-time.After(dr.delays[host]):
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestRaceDialResolve(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer ln.Close()
+	go func() {
+		for {
+			conn, exx := ln.Accept()
+			if exx != nil {
+				return
+			}
+			_ = conn.Close() // TLS 握手失败，明文连接成功
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	opt := &option{selector: NewRoundRobinSelector(), race: 50 * time.Millisecond, slog: new(stdLog)}
+	rd := newDialer([]string{"slow.test:" + port, "fast.test:" + port}, "", opt).(*raceDial)
+	resolver := &delayResolver{
+		delays: map[string]time.Duration{"slow.test": 2 * time.Second},
+		counts: make(map[string]int, 2),
+	}
+	rd.resolver = resolver
+
+	start := time.Now()
+	conn, addr, err := rd.iterDial(context.Background(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if du := time.Since(start); du > time.Second {
+		t.Fatalf("应在收到第一个解析结果后立即连接，实际耗时 %s", du)
+	}
+	if addr.TLS || addr.Addr != "fast.test:"+port {
+		t.Fatalf("期望连接 fast.test 的明文地址，实际 %+v", addr)
+	}
+
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	if resolver.counts["slow.test"] != 1 || resolver.counts["fast.test"] != 1 {
+		t.Fatalf("同一主机的地址应共用解析结果：%v", resolver.counts)
+	}
+}
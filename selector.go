@@ -0,0 +1,446 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Selector broker 地址选择策略。
+//
+// 每次连接 broker 前会调用 Select 选择要连接的地址，连接完成后调用 Report 反馈结果，
+// 实现者可以根据反馈结果避开不可用的地址。连接成功但握手失败时会再次调用 Report 反馈握手错误。
+type Selector interface {
+	// Select 从 addrs 中选择下一个要连接的地址，addrs 不会为空。
+	Select(addrs Addresses) *Address
+
+	// Report 反馈连接结果，err 为 nil 代表连接成功，rtt 为建立连接（或握手）的耗时。
+	Report(addr *Address, rtt time.Duration, err error)
+}
+
+// NewRoundRobinSelector 轮询策略，按照顺序依次尝试每个地址，这是默认的选择策略。
+func NewRoundRobinSelector() Selector {
+	return new(roundRobinSelector)
+}
+
+// NewRandomSelector 随机策略，每次随机选择一个地址。
+func NewRandomSelector() Selector {
+	return new(randomSelector)
+}
+
+// NewPrioritySelector 优先级分组策略。
+//
+// priority 计算每个地址的优先级，数值越小优先级越高，相同优先级的地址为一组，组内轮询。
+// 只有当高优先级组内的地址在 cooldown 时间内全部连接失败时，才会降级到下一组；
+// 高优先级组的地址冷却结束后会被优先重试。cooldown 小于等于 0 时默认为 1min。
+//
+// 例如优先连接同机房的 broker：
+//
+//	tunnel.NewPrioritySelector(func(addr *tunnel.Address) int {
+//		if strings.HasPrefix(addr.Addr, "10.1.") {
+//			return 0
+//		}
+//		return 1
+//	}, 0)
+func NewPrioritySelector(priority func(*Address) int, cooldown time.Duration) Selector {
+	if cooldown <= 0 {
+		cooldown = time.Minute
+	}
+	return &prioritySelector{
+		priority: priority,
+		failure:  newFailure(cooldown),
+		indexes:  make(map[int]int, 4),
+	}
+}
+
+// NewLatencySelector 最低延迟策略。
+//
+// 并行对所有地址发起 TCP 探测，选择延迟最低且最近没有连接失败的地址。
+// 探测会经过 WithProxy 配置的代理，相同 host:port 的 TLS 与明文地址只探测一次，
+// 通道关闭时正在进行的探测会被取消。
+// 探测结果的有效期为 ttl，过期或所有地址都连接失败后会重新探测。
+// timeout 为每次探测的超时时间，小于等于 0 时默认为 3s；ttl 小于等于 0 时默认为 10min。
+func NewLatencySelector(timeout, ttl time.Duration) Selector {
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	if ttl <= 0 {
+		ttl = 10 * time.Minute
+	}
+	return &latencySelector{
+		timeout: timeout,
+		ttl:     ttl,
+		failure: newFailure(ttl),
+	}
+}
+
+// NewStickySelector 粘滞策略，优先连接上一次握手成功的 broker。
+//
+// 握手成功的地址会持久化到 file 中，程序重启后依然会优先连接该地址。
+// 粘滞的地址连接失败后交由 next 选择，next 为 nil 时默认使用轮询策略。
+func NewStickySelector(file string, next Selector) Selector {
+	if next == nil {
+		next = NewRoundRobinSelector()
+	}
+	ss := &stickySelector{file: file, next: next}
+	ss.load()
+
+	return ss
+}
+
+type roundRobinSelector struct {
+	mutex sync.Mutex
+	index int
+}
+
+func (rr *roundRobinSelector) Select(addrs Addresses) *Address {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	idx := rr.index % len(addrs)
+	rr.index = (idx + 1) % len(addrs)
+
+	return addrs[idx]
+}
+
+func (*roundRobinSelector) Report(*Address, time.Duration, error) {}
+
+type randomSelector struct{}
+
+func (randomSelector) Select(addrs Addresses) *Address {
+	return addrs[rand.IntN(len(addrs))]
+}
+
+func (randomSelector) Report(*Address, time.Duration, error) {}
+
+type prioritySelector struct {
+	priority func(*Address) int
+	failure  *failure
+	mutex    sync.Mutex
+	indexes  map[int]int // 每组的轮询下标
+}
+
+func (ps *prioritySelector) Select(addrs Addresses) *Address {
+	groups := make(map[int]Addresses, 4)
+	levels := make([]int, 0, 4)
+	for _, addr := range addrs {
+		lvl := ps.priority(addr)
+		if _, ok := groups[lvl]; !ok {
+			levels = append(levels, lvl)
+		}
+		groups[lvl] = append(groups[lvl], addr)
+	}
+	slices.Sort(levels)
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for _, lvl := range levels {
+		group := groups[lvl]
+		size := len(group)
+		start := ps.indexes[lvl]
+		for i := 0; i < size; i++ {
+			idx := (start + i) % size
+			if addr := group[idx]; !ps.failure.failed(addr) {
+				ps.indexes[lvl] = idx + 1
+				return addr
+			}
+		}
+	}
+
+	// 所有地址都在冷却中，选择最早失败的地址重试。
+	return ps.failure.oldest(addrs)
+}
+
+func (ps *prioritySelector) Report(addr *Address, _ time.Duration, err error) {
+	ps.failure.report(addr, err)
+}
+
+// probeFunc 探测 addr 的 TCP 连接（不进行 TLS 握手）。
+type probeFunc func(ctx context.Context, addr *Address) (net.Conn, error)
+
+// probeSelector 需要主动探测地址的选择策略。连接器会传入本次连接的上下文以及
+// 经过代理的探测函数，通道关闭时探测随之取消。
+type probeSelector interface {
+	selectProbe(ctx context.Context, addrs Addresses, dial probeFunc) *Address
+}
+
+// handshakeReporter 需要区分连接结果与握手结果的选择策略。Report 在 TCP/TLS 连接结束时调用，
+// 连接成功不代表 broker 接受了该节点，连接器会在握手结束后再调用 handshaked。
+type handshakeReporter interface {
+	handshaked(addr *Address, err error)
+}
+
+// directProbe 直连探测 addr。
+func directProbe(ctx context.Context, addr *Address) (net.Conn, error) {
+	return new(net.Dialer).DialContext(ctx, "tcp", addr.Addr)
+}
+
+type latencySelector struct {
+	timeout time.Duration
+	ttl     time.Duration
+	failure *failure
+	mutex   sync.Mutex
+	probeAt time.Time
+	sorted  Addresses // 按照延迟从低到高排序，探测失败的地址排在最后
+}
+
+func (ls *latencySelector) Select(addrs Addresses) *Address {
+	return ls.selectProbe(context.Background(), addrs, directProbe)
+}
+
+func (ls *latencySelector) selectProbe(ctx context.Context, addrs Addresses, dial probeFunc) *Address {
+	ls.mutex.Lock()
+	stale := time.Since(ls.probeAt) > ls.ttl || len(ls.sorted) != len(addrs) || ls.allFailed()
+	ls.mutex.Unlock()
+	if stale { // 探测期间不持有锁
+		ls.probe(ctx, addrs, dial)
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	sorted := ls.sorted
+	if len(sorted) != len(addrs) { // 探测被取消，还没有探测结果
+		sorted = addrs
+	}
+	for _, addr := range sorted {
+		if !ls.failure.failed(addr) {
+			return addr
+		}
+	}
+
+	return ls.failure.oldest(sorted)
+}
+
+func (ls *latencySelector) Report(addr *Address, _ time.Duration, err error) {
+	ls.failure.report(addr, err)
+}
+
+func (ls *latencySelector) allFailed() bool {
+	for _, addr := range ls.sorted {
+		if !ls.failure.failed(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// probe 并行探测所有地址的 TCP 连接延迟，相同 host:port 的地址只探测一次。
+// parent 被取消时放弃本次探测结果。
+func (ls *latencySelector) probe(parent context.Context, addrs Addresses, dial probeFunc) {
+	uniq := make(map[string]*Address, len(addrs))
+	for _, addr := range addrs {
+		if _, ok := uniq[addr.Addr]; !ok {
+			uniq[addr.Addr] = addr
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(parent, ls.timeout)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	rtts := make(map[string]time.Duration, len(uniq))
+	for hostport, addr := range uniq {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt := time.Duration(-1)
+			start := time.Now()
+			if conn, err := dial(ctx, addr); err == nil {
+				rtt = time.Since(start)
+				_ = conn.Close()
+			}
+			mutex.Lock()
+			rtts[hostport] = rtt
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+	if parent.Err() != nil {
+		return
+	}
+
+	sorted := slices.Clone(addrs)
+	slices.SortStableFunc(sorted, func(a, b *Address) int {
+		ra, rb := rtts[a.Addr], rtts[b.Addr]
+		switch {
+		case ra == rb:
+			return 0
+		case ra < 0:
+			return 1
+		case rb < 0:
+			return -1
+		case ra < rb:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ls.sorted = sorted
+	ls.probeAt = time.Now()
+	ls.failure.reset()
+}
+
+type stickySelector struct {
+	file   string
+	next   Selector
+	mutex  sync.Mutex
+	sticky *Address // 上次连接成功的地址
+	failed bool     // 粘滞地址最近一次连接是否失败
+}
+
+func (ss *stickySelector) Select(addrs Addresses) *Address {
+	if addr := ss.stuck(addrs); addr != nil {
+		return addr
+	}
+
+	return ss.next.Select(addrs)
+}
+
+func (ss *stickySelector) selectProbe(ctx context.Context, addrs Addresses, dial probeFunc) *Address {
+	if addr := ss.stuck(addrs); addr != nil {
+		return addr
+	}
+	if ps, ok := ss.next.(probeSelector); ok {
+		return ps.selectProbe(ctx, addrs, dial)
+	}
+
+	return ss.next.Select(addrs)
+}
+
+// stuck 返回 addrs 中可用的粘滞地址，没有时返回 nil。
+func (ss *stickySelector) stuck(addrs Addresses) *Address {
+	ss.mutex.Lock()
+	sticky, failed := ss.sticky, ss.failed
+	ss.mutex.Unlock()
+
+	if sticky != nil && !failed {
+		for _, addr := range addrs {
+			if addr.TLS == sticky.TLS && addr.Addr == sticky.Addr {
+				return addr
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ss *stickySelector) Report(addr *Address, rtt time.Duration, err error) {
+	ss.next.Report(addr, rtt, err)
+	if err == nil { // 连接成功后还需要握手，握手成功后才会记录粘滞地址
+		return
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.sticky != nil && ss.sticky.TLS == addr.TLS && ss.sticky.Addr == addr.Addr {
+		ss.failed = true
+	}
+}
+
+// handshaked 握手成功后记录并持久化粘滞地址，握手失败已经通过 Report 上报。
+func (ss *stickySelector) handshaked(addr *Address, err error) {
+	if err != nil {
+		return
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	ss.failed = false
+	if ss.sticky == nil || ss.sticky.TLS != addr.TLS || ss.sticky.Addr != addr.Addr {
+		ss.sticky = &Address{TLS: addr.TLS, Addr: addr.Addr, Name: addr.Name}
+		ss.save()
+	}
+}
+
+func (ss *stickySelector) load() {
+	if ss.file == "" {
+		return
+	}
+	raw, err := os.ReadFile(ss.file)
+	if err != nil {
+		return
+	}
+	addr := new(Address)
+	if err = json.Unmarshal(raw, addr); err == nil && addr.Addr != "" {
+		ss.sticky = addr
+	}
+}
+
+func (ss *stickySelector) save() {
+	if ss.file == "" {
+		return
+	}
+	raw, err := json.Marshal(ss.sticky)
+	if err != nil {
+		return
+	}
+	tmp := ss.file + ".tmp"
+	if err = os.WriteFile(tmp, raw, 0o600); err == nil {
+		_ = os.Rename(tmp, ss.file)
+	}
+}
+
+// failure 记录地址连接失败的时间，冷却期内的地址视为不可用。
+type failure struct {
+	cooldown time.Duration
+	mutex    sync.Mutex
+	times    map[*Address]time.Time
+}
+
+func newFailure(cooldown time.Duration) *failure {
+	return &failure{cooldown: cooldown, times: make(map[*Address]time.Time, 8)}
+}
+
+func (f *failure) report(addr *Address, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if err == nil {
+		delete(f.times, addr)
+	} else {
+		f.times[addr] = time.Now()
+	}
+}
+
+func (f *failure) failed(addr *Address) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	at, ok := f.times[addr]
+	return ok && time.Since(at) < f.cooldown
+}
+
+// oldest 返回最早失败的地址。
+func (f *failure) oldest(addrs Addresses) *Address {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	ret := addrs[0]
+	for _, addr := range addrs[1:] {
+		if f.times[addr].Before(f.times[ret]) {
+			ret = addr
+		}
+	}
+
+	return ret
+}
+
+func (f *failure) reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	clear(f.times)
+}
@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAddrs() Addresses {
+	return Addresses{
+		{TLS: true, Addr: "10.1.0.1:443"},
+		{TLS: true, Addr: "10.1.0.2:443"},
+		{TLS: true, Addr: "10.2.0.1:443"},
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	addrs := testAddrs()
+	sel := NewRoundRobinSelector()
+	for i := 0; i < 6; i++ {
+		if addr := sel.Select(addrs); addr != addrs[i%3] {
+			t.Fatalf("第 %d 次期望选择 %s，实际 %s", i, addrs[i%3], addr)
+		}
+	}
+}
+
+func TestPrioritySelector(t *testing.T) {
+	addrs := testAddrs()
+	sel := NewPrioritySelector(func(addr *Address) int {
+		if strings.HasPrefix(addr.Addr, "10.1.") {
+			return 0
+		}
+		return 1
+	}, time.Minute)
+
+	exx := errors.New("refused")
+	seen := make(map[*Address]bool)
+	for i := 0; i < 2; i++ {
+		addr := sel.Select(addrs)
+		if addr == addrs[2] {
+			t.Fatalf("高优先级组可用时不应选择低优先级地址")
+		}
+		seen[addr] = true
+		sel.Report(addr, 0, exx)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("组内应轮询，实际选择了 %d 个地址", len(seen))
+	}
+
+	if addr := sel.Select(addrs); addr != addrs[2] {
+		t.Fatalf("高优先级组全部失败后应降级，实际选择 %s", addr)
+	}
+
+	sel.Report(addrs[0], 0, nil)
+	if addr := sel.Select(addrs); addr != addrs[0] {
+		t.Fatalf("高优先级地址恢复后应优先选择，实际选择 %s", addr)
+	}
+}
+
+func TestLatencySelector(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	addrs := Addresses{{Addr: deadAddr}, {Addr: ln.Addr().String()}}
+	sel := NewLatencySelector(time.Second, time.Minute)
+	if addr := sel.Select(addrs); addr != addrs[1] {
+		t.Fatalf("应选择可连接的地址，实际选择 %s", addr)
+	}
+}
+
+func TestLatencySelectorProbe(t *testing.T) {
+	addrs := Addresses{
+		{TLS: true, Addr: "10.9.0.1:8080"},
+		{Addr: "10.9.0.1:8080"},
+		{TLS: true, Addr: "10.9.0.2:443"},
+	}
+	ls := NewLatencySelector(time.Second, time.Minute).(*latencySelector)
+
+	var mutex sync.Mutex
+	dials := make(map[string]int)
+	dial := func(_ context.Context, addr *Address) (net.Conn, error) {
+		mutex.Lock()
+		dials[addr.Addr]++
+		mutex.Unlock()
+		if addr.Addr == "10.9.0.1:8080" {
+			return nil, errors.New("refused")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	}
+	if addr := ls.selectProbe(context.Background(), addrs, dial); addr != addrs[2] {
+		t.Fatalf("应选择可连接的地址，实际选择 %s", addr)
+	}
+	if len(dials) != 2 || dials["10.9.0.1:8080"] != 1 {
+		t.Fatalf("相同 host:port 应只探测一次：%v", dials)
+	}
+
+	// 探测可以被取消，且取消时不会阻塞其它 Select。
+	ls = NewLatencySelector(time.Minute, time.Minute).(*latencySelector)
+	block := func(ctx context.Context, _ *Address) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if addr := ls.selectProbe(ctx, addrs, block); addr != addrs[0] {
+		t.Fatalf("探测取消后应按照原顺序选择，实际选择 %s", addr)
+	}
+	if du := time.Since(start); du > 5*time.Second {
+		t.Fatalf("探测未被取消：%s", du)
+	}
+}
+
+func TestStickySelector(t *testing.T) {
+	addrs := testAddrs()
+	file := filepath.Join(t.TempDir(), "sticky.json")
+
+	sel := NewStickySelector(file, nil)
+	if addr := sel.Select(addrs); addr != addrs[0] {
+		t.Fatalf("无粘滞记录时应交由轮询策略，实际选择 %s", addr)
+	}
+	sel.Report(addrs[2], time.Millisecond, nil)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatal("握手成功前不应记录粘滞地址")
+	}
+	sel.(handshakeReporter).handshaked(addrs[2], nil)
+
+	// 模拟重启
+	sel = NewStickySelector(file, nil)
+	if addr := sel.Select(addrs); addr != addrs[2] {
+		t.Fatalf("重启后应优先选择上次成功的地址，实际选择 %s", addr)
+	}
+
+	sel.Report(addrs[2], 0, errors.New("refused"))
+	if addr := sel.Select(addrs); addr == addrs[2] {
+		t.Fatal("粘滞地址连接失败后应交由下一个策略选择")
+	}
+}
@@ -0,0 +1,303 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ServicePreface broker 访问 agent 本地服务时使用的流前导名称，
+// 需要将 Tunneler.Services 注册到 Mux 中才能生效：
+//
+//	mux := tunnel.NewMux(httpSrv)
+//	tun, _ := tunnel.Dial(ctx, hide, mux)
+//	mux.Handle(tunnel.ServicePreface, tun.Services())
+const ServicePreface = "service"
+
+// 服务请求的响应状态码。
+const (
+	serviceOK       byte = 0x00 // 连接成功
+	serviceRejected byte = 0x01 // 服务未注册或者被拒绝
+	serviceFailed   byte = 0x02 // 连接本地服务失败
+)
+
+// ErrServiceRejected 服务未注册或者被 ServiceRegistry.SetAllow 设置的访问控制拒绝。
+var ErrServiceRejected = errors.New("服务未注册或被拒绝访问")
+
+// DialService broker 端在 conn（broker 打开的流）上请求访问 agent 本地服务 name，
+// 成功后 conn 即为与该服务之间的双向数据流。
+func DialService(conn net.Conn, name string) error {
+	if err := WritePreface(conn, ServicePreface); err != nil {
+		return err
+	}
+	if err := WritePreface(conn, name); err != nil {
+		return err
+	}
+
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	msg := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return err
+	}
+	switch head[0] {
+	case serviceOK:
+		return nil
+	case serviceRejected:
+		return fmt.Errorf("%w：%s", ErrServiceRejected, msg)
+	default:
+		return fmt.Errorf("连接服务 %s 失败：%s", name, msg)
+	}
+}
+
+// ServiceTarget 本地服务地址。
+type ServiceTarget struct {
+	Network string `json:"network"` // tcp 或 unix
+	Address string `json:"address"` // 例如：127.0.0.1:22、/run/metrics.sock
+}
+
+// ServiceAudit 服务访问审计事件，每个会话开始与结束时各通知一次，被拒绝的请求只通知一次。
+type ServiceAudit struct {
+	Name     string        `json:"name"`     // 服务名称
+	Target   ServiceTarget `json:"target"`   // 本地服务地址，被拒绝时为空
+	Meta     StreamMeta    `json:"meta"`     // 流的元数据
+	Start    time.Time     `json:"start"`    // 会话开始时间
+	End      time.Time     `json:"end"`      // 会话结束时间，会话开始时为零值
+	Sent     int64         `json:"sent"`     // 本地服务发往 broker 的字节数
+	Received int64         `json:"received"` // broker 发往本地服务的字节数
+	Err      error         `json:"-"`        // 被拒绝、连接失败或会话异常结束的原因
+}
+
+// ServiceRegistry agent 本地服务注册表，broker 只能通过名称访问已注册的服务，
+// 不能指定任意的目标地址。注册表的所有方法都是并发安全的，可以在服务运行期间调用。
+type ServiceRegistry struct {
+	mutex    sync.RWMutex
+	services map[string]ServiceTarget
+	allow    func(name string, meta StreamMeta) bool
+	auditFn  func(ServiceAudit)
+	idle     time.Duration
+}
+
+// NewServiceRegistry 创建本地服务注册表。
+func NewServiceRegistry() *ServiceRegistry {
+	return &ServiceRegistry{services: make(map[string]ServiceTarget, 8)}
+}
+
+// SetAllow 设置访问控制，在服务已注册的前提下进一步决定是否允许 broker 访问，为 nil 代表允许。
+func (sr *ServiceRegistry) SetAllow(fn func(name string, meta StreamMeta) bool) {
+	sr.mutex.Lock()
+	sr.allow = fn
+	sr.mutex.Unlock()
+}
+
+// SetAudit 设置审计回调，每个会话开始、结束以及请求被拒绝时调用，需要自己保证并发安全。
+func (sr *ServiceRegistry) SetAudit(fn func(ServiceAudit)) {
+	sr.mutex.Lock()
+	sr.auditFn = fn
+	sr.mutex.Unlock()
+}
+
+// SetIdleTimeout 设置会话空闲超时时间，超时没有任何数据传输则断开，小于等于 0 时默认 10min。
+// 只对之后建立的会话生效。
+func (sr *ServiceRegistry) SetIdleTimeout(du time.Duration) {
+	sr.mutex.Lock()
+	sr.idle = du
+	sr.mutex.Unlock()
+}
+
+// Register 注册本地服务，重复注册会覆盖，例如：
+//
+//	reg.Register("ssh", "tcp", "127.0.0.1:22")
+//	reg.Register("metrics", "unix", "/run/metrics.sock")
+func (sr *ServiceRegistry) Register(name, network, address string) error {
+	if size := len(name); size == 0 || size > 255 {
+		return errors.New("服务名称长度必须在 1-255 之间")
+	}
+	if network != "tcp" && network != "unix" {
+		return fmt.Errorf("不支持的服务网络类型：%s", network)
+	}
+
+	sr.mutex.Lock()
+	sr.services[name] = ServiceTarget{Network: network, Address: address}
+	sr.mutex.Unlock()
+
+	return nil
+}
+
+// Unregister 注销本地服务，已经建立的会话不受影响。
+func (sr *ServiceRegistry) Unregister(name string) {
+	sr.mutex.Lock()
+	delete(sr.services, name)
+	sr.mutex.Unlock()
+}
+
+// Services 已注册的服务。
+func (sr *ServiceRegistry) Services() map[string]ServiceTarget {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+
+	ret := make(map[string]ServiceTarget, len(sr.services))
+	for name, target := range sr.services {
+		ret[name] = target
+	}
+
+	return ret
+}
+
+// Serve 处理 broker 的服务访问请求，实现了 Server 接口。
+func (sr *ServiceRegistry) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go sr.serveConn(conn)
+	}
+}
+
+func (sr *ServiceRegistry) serveConn(conn net.Conn) {
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	var meta StreamMeta
+	if bc, ok := conn.(*BrokerConn); ok {
+		meta = bc.Meta()
+	}
+	audit := ServiceAudit{Meta: meta, Start: time.Now()}
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	name, err := readPreface(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return
+	}
+	audit.Name = name
+
+	sr.mutex.RLock()
+	target, ok := sr.services[name]
+	allow, idle := sr.allow, sr.idle
+	sr.mutex.RUnlock()
+	if !ok || (allow != nil && !allow(name, meta)) {
+		audit.End, audit.Err = time.Now(), ErrServiceRejected
+		_ = writeServiceStatus(conn, serviceRejected, name)
+		sr.audit(audit)
+		return
+	}
+	audit.Target = target
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	local, err := dialer.Dial(target.Network, target.Address)
+	if err != nil {
+		audit.End, audit.Err = time.Now(), err
+		_ = writeServiceStatus(conn, serviceFailed, err.Error())
+		sr.audit(audit)
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer local.Close()
+
+	if err = writeServiceStatus(conn, serviceOK, ""); err != nil {
+		return
+	}
+	sr.audit(audit)
+
+	if idle <= 0 {
+		idle = 10 * time.Minute
+	}
+	var sent, received atomic.Int64
+	err = pipeIdle(conn, local, idle, &received, &sent)
+	audit.End, audit.Err = time.Now(), err
+	audit.Sent, audit.Received = sent.Load(), received.Load()
+	sr.audit(audit)
+}
+
+func (sr *ServiceRegistry) audit(evt ServiceAudit) {
+	sr.mutex.RLock()
+	fn := sr.auditFn
+	sr.mutex.RUnlock()
+	if fn != nil {
+		fn(evt)
+	}
+}
+
+// pipeIdle 双向拷贝数据，任意一个方向结束或者空闲超时后关闭两端。
+// a2b、b2a 分别统计 a 发往 b、b 发往 a 的字节数。
+func pipeIdle(a, b net.Conn, idle time.Duration, a2b, b2a *atomic.Int64) error {
+	var timeout atomic.Bool
+	timer := time.AfterFunc(idle, func() {
+		timeout.Store(true)
+		_ = a.Close()
+		_ = b.Close()
+	})
+	defer timer.Stop()
+
+	errc := make(chan error, 2)
+	copyFn := func(dst, src net.Conn, n *atomic.Int64) {
+		w := &idleWriter{countWriter: countWriter{w: dst, n: n}, timer: timer, idle: idle}
+		_, err := io.Copy(w, src)
+		errc <- err
+		_ = a.Close()
+		_ = b.Close()
+	}
+	go copyFn(b, a, a2b)
+	go copyFn(a, b, b2a)
+	err := <-errc
+	<-errc
+
+	if timeout.Load() {
+		return context.DeadlineExceeded
+	}
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+		err = nil
+	}
+
+	return err
+}
+
+// idleWriter 每次写入数据后重置空闲计时器。
+type idleWriter struct {
+	countWriter
+	timer *time.Timer
+	idle  time.Duration
+}
+
+func (iw *idleWriter) Write(p []byte) (int, error) {
+	iw.timer.Reset(iw.idle)
+	return iw.countWriter.Write(p)
+}
+
+// readPreface 读取 WritePreface 写入的前导数据。
+func readPreface(r io.Reader) (string, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return "", err
+	}
+	if head[0] != prefaceMagic {
+		return "", errors.New("前导数据格式错误")
+	}
+	name := make([]byte, head[1])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+
+	return string(name), nil
+}
+
+func writeServiceStatus(w io.Writer, code byte, msg string) error {
+	if len(msg) > 255 {
+		msg = msg[:255]
+	}
+	buf := make([]byte, 0, len(msg)+2)
+	buf = append(buf, code, byte(len(msg)))
+	buf = append(buf, msg...)
+	_, err := w.Write(buf)
+
+	return err
+}
@@ -0,0 +1,674 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SOCKS5 应答码（RFC 1928 6）。
+const (
+	socksSucceeded         byte = 0x00
+	socksGeneralFailure    byte = 0x01
+	socksNotAllowed        byte = 0x02
+	socksHostUnreachable   byte = 0x04
+	socksCmdNotSupported   byte = 0x07
+	socksAddrNotSupported  byte = 0x08
+	socksCmdConnect        byte = 0x01
+	socksCmdUDPAssociate   byte = 0x03
+	socksAtypIPv4          byte = 0x01
+	socksAtypDomain        byte = 0x03
+	socksAtypIPv6          byte = 0x04
+	socksAuthNone          byte = 0x00
+	socksAuthPassword      byte = 0x02
+	socksAuthNoAcceptable  byte = 0xff
+	socksPasswordVersion   byte = 0x01
+	socksPasswordSucceeded byte = 0x00
+)
+
+// SOCKS5Server 本地 SOCKS5 代理服务（支持 CONNECT 与 UDP ASSOCIATE），所有出站连接
+// 都经由 broker 的 /api/v1/broker/stream/tunnel 接口转发，使本机上的工具可以访问
+// 中心端网络中的目标，而不需要自己的网络路径。
+//
+//	srv := tunnel.NewSOCKS5Server(tun)
+//	srv.Users = map[string]string{"ops": "secret"}
+//	srv.Deny = []string{"10.0.0.0/8"}
+//	go srv.ListenAndServe("127.0.0.1:1080")
+type SOCKS5Server struct {
+	// Users 用户名与密码，为空时不需要认证。
+	Users map[string]string
+
+	// Allow 允许访问的目标，为空代表允许所有目标。
+	// Deny 禁止访问的目标，优先级高于 Allow。
+	//
+	// 规则格式：
+	//
+	//	example.com        精确匹配域名
+	//	*.example.com      匹配子域名（不含 example.com 本身）
+	//	10.0.0.0/8         匹配 IP 段
+	//	192.168.1.10       匹配 IP
+	//	example.com:443    以上任意格式都可以加上端口号，只匹配该端口
+	//
+	// Allow 中的 IP 规则不会匹配域名目标（即域名目标需要 Allow 中有对应的域名规则）。
+	// Deny 中有 IP 规则时，域名目标会先在本地解析，任意一个解析结果被禁止则拒绝访问，
+	// 否则直接连接解析出的 IP，防止 broker 解析出不同的地址绕过禁止规则；
+	// 本地无法解析的域名一律拒绝。
+	Allow []string
+	Deny  []string
+
+	// Resolver 按照 Deny 的 IP 规则检查域名目标时使用的解析器，默认为 net.DefaultResolver。
+	Resolver *net.Resolver
+
+	// UDPIdleTimeout UDP 目标的空闲超时时间，默认 1min。
+	UDPIdleTimeout time.Duration
+
+	tun   Tunneler
+	mutex sync.Mutex
+	stats map[string]*socksStat
+	ln    net.Listener
+}
+
+// SOCKS5Stat 某个目标地址的访问统计。
+type SOCKS5Stat struct {
+	Conns    int64     `json:"conns"`    // 累计连接数，UDP 每个目标地址计一次
+	Rejected int64     `json:"rejected"` // 被规则拒绝的次数
+	Failed   int64     `json:"failed"`   // 连接失败的次数
+	Sent     int64     `json:"sent"`     // 发往目标的字节数
+	Received int64     `json:"received"` // 从目标收到的字节数
+	LastAt   time.Time `json:"last_at"`  // 最近一次访问时间
+}
+
+// socksMaxStats 最多统计的目标地址数，超出后淘汰最久未访问的目标。
+const socksMaxStats = 1024
+
+// socksMaxQueue UDP 目标的流建立期间最多缓存的数据报数，超出后丢弃。
+const socksMaxQueue = 32
+
+type socksStat struct {
+	conns, rejected, failed atomic.Int64
+	sent, received          atomic.Int64
+	lastAt                  atomic.Int64
+}
+
+// NewSOCKS5Server 创建经由通道出站的 SOCKS5 代理服务。
+func NewSOCKS5Server(tun Tunneler) *SOCKS5Server {
+	return &SOCKS5Server{tun: tun, stats: make(map[string]*socksStat, 32)}
+}
+
+// ListenAndServe 监听 addr 并提供服务。
+func (s *SOCKS5Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve 在 ln 上提供服务，直至 ln 关闭。
+func (s *SOCKS5Server) Serve(ln net.Listener) error {
+	s.mutex.Lock()
+	s.ln = ln
+	s.mutex.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close 关闭监听，已建立的连接不受影响。
+func (s *SOCKS5Server) Close() error {
+	s.mutex.Lock()
+	ln := s.ln
+	s.mutex.Unlock()
+	if ln == nil {
+		return nil
+	}
+
+	return ln.Close()
+}
+
+// Stats 按照目标地址（host:port）统计的访问数据，最多保留最近访问的 1024 个目标。
+func (s *SOCKS5Server) Stats() map[string]SOCKS5Stat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := make(map[string]SOCKS5Stat, len(s.stats))
+	for dest, st := range s.stats {
+		ret[dest] = SOCKS5Stat{
+			Conns:    st.conns.Load(),
+			Rejected: st.rejected.Load(),
+			Failed:   st.failed.Load(),
+			Sent:     st.sent.Load(),
+			Received: st.received.Load(),
+			LastAt:   time.Unix(0, st.lastAt.Load()),
+		}
+	}
+
+	return ret
+}
+
+func (s *SOCKS5Server) stat(dest string) *socksStat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := s.stats[dest]
+	if st == nil {
+		if len(s.stats) >= socksMaxStats {
+			s.evictStat()
+		}
+		st = new(socksStat)
+		s.stats[dest] = st
+	}
+	st.lastAt.Store(time.Now().UnixNano())
+
+	return st
+}
+
+// evictStat 淘汰最久未访问的目标统计，调用方需持有锁。
+func (s *SOCKS5Server) evictStat() {
+	var oldest string
+	var at int64
+	for dest, st := range s.stats {
+		if last := st.lastAt.Load(); oldest == "" || last < at {
+			oldest, at = dest, last
+		}
+	}
+	delete(s.stats, oldest)
+}
+
+func (s *SOCKS5Server) serveConn(conn net.Conn) {
+	//goland:noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+	rd := bufio.NewReader(conn)
+	if err := s.negotiate(rd, conn); err != nil {
+		return
+	}
+
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(rd, head); err != nil || head[0] != 0x05 {
+		return
+	}
+	dest, err := readSocksAddr(rd)
+	if err != nil {
+		_ = writeSocksReply(conn, socksAddrNotSupported, nil)
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	switch head[1] {
+	case socksCmdConnect:
+		s.connect(conn, dest)
+	case socksCmdUDPAssociate:
+		s.associate(conn)
+	default:
+		_ = writeSocksReply(conn, socksCmdNotSupported, nil)
+	}
+}
+
+// negotiate 协商认证方式并认证。
+func (s *SOCKS5Server) negotiate(rd *bufio.Reader, w io.Writer) error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(rd, head); err != nil {
+		return err
+	}
+	if head[0] != 0x05 {
+		return errors.New("不是 SOCKS5 协议")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(rd, methods); err != nil {
+		return err
+	}
+
+	want := socksAuthNone
+	if len(s.Users) != 0 {
+		want = socksAuthPassword
+	}
+	if !strings.ContainsRune(string(methods), rune(want)) {
+		_, _ = w.Write([]byte{0x05, socksAuthNoAcceptable})
+		return errors.New("没有可接受的认证方式")
+	}
+	if _, err := w.Write([]byte{0x05, want}); err != nil {
+		return err
+	}
+	if want == socksAuthNone {
+		return nil
+	}
+
+	// RFC 1929 用户名密码认证
+	if _, err := io.ReadFull(rd, head); err != nil {
+		return err
+	}
+	username := make([]byte, head[1])
+	if _, err := io.ReadFull(rd, username); err != nil {
+		return err
+	}
+	size, err := rd.ReadByte()
+	if err != nil {
+		return err
+	}
+	passwd := make([]byte, size)
+	if _, err = io.ReadFull(rd, passwd); err != nil {
+		return err
+	}
+	if !s.authenticate(username, passwd) {
+		_, _ = w.Write([]byte{socksPasswordVersion, 0x01})
+		return errors.New("SOCKS5 认证失败")
+	}
+	_, err = w.Write([]byte{socksPasswordVersion, socksPasswordSucceeded})
+
+	return err
+}
+
+// authenticate 校验用户名密码，使用常量时间比较，避免通过响应时间猜测。
+func (s *SOCKS5Server) authenticate(username, passwd []byte) bool {
+	var ok int
+	for user, pwd := range s.Users {
+		ok |= subtle.ConstantTimeCompare([]byte(user), username) & subtle.ConstantTimeCompare([]byte(pwd), passwd)
+	}
+
+	return ok == 1
+}
+
+func (s *SOCKS5Server) connect(conn net.Conn, dest string) {
+	st := s.stat(dest)
+	target, ok := s.check(dest)
+	if !ok {
+		st.rejected.Add(1)
+		_ = writeSocksReply(conn, socksNotAllowed, nil)
+		return
+	}
+
+	ws, err := dialRelay(context.Background(), s.tun, "tcp", target)
+	if err != nil {
+		st.failed.Add(1)
+		_ = writeSocksReply(conn, socksHostUnreachable, nil)
+		return
+	}
+	st.conns.Add(1)
+	remote := &websocketConn{ws: ws, rd: websocket.JoinMessages(ws, "")}
+	//goland:noinspection GoUnhandledErrorResult
+	defer remote.Close()
+
+	if err = writeSocksReply(conn, socksSucceeded, nil); err != nil {
+		return
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		_, exx := io.Copy(&countWriter{w: remote, n: &st.sent}, conn)
+		errc <- exx
+	}()
+	go func() {
+		_, exx := io.Copy(&countWriter{w: conn, n: &st.received}, remote)
+		errc <- exx
+	}()
+	<-errc
+	_ = conn.Close()
+	_ = remote.Close()
+	<-errc
+}
+
+// associate 处理 UDP ASSOCIATE，控制连接断开后 UDP 转发随之结束。
+func (s *SOCKS5Server) associate(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = writeSocksReply(conn, socksGeneralFailure, nil)
+		return
+	}
+	//goland:noinspection GoUnhandledErrorResult
+	defer pc.Close()
+
+	if err = writeSocksReply(conn, socksSucceeded, pc.LocalAddr()); err != nil {
+		return
+	}
+
+	client, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	relay := &socksUDPRelay{srv: s, pc: pc, client: net.ParseIP(client), targets: make(map[string]*socksTarget, 8)}
+	go relay.serve()
+	defer relay.close()
+
+	_, _ = io.Copy(io.Discard, conn) // 阻塞直至控制连接断开
+}
+
+// check 检查目标地址是否允许访问，返回实际要连接的地址。
+// 域名目标在 Deny 中有 IP 规则时会被解析并固定为解析出的 IP。
+func (s *SOCKS5Server) check(dest string) (string, bool) {
+	if !s.allowed(dest) {
+		return "", false
+	}
+	host, port, _ := net.SplitHostPort(dest)
+	if net.ParseIP(host) != nil || !hasIPRule(s.Deny) {
+		return dest, true
+	}
+
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ips, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return "", false // 无法确认解析结果，拒绝访问
+	}
+	for _, ip := range ips {
+		for _, rule := range s.Deny {
+			if matchDest(rule, net.JoinHostPort(ip.IP.String(), port)) {
+				return "", false
+			}
+		}
+	}
+
+	return net.JoinHostPort(ips[0].IP.String(), port), true
+}
+
+// hasIPRule 规则中是否有 IP 或 IP 段规则。
+func hasIPRule(rules []string) bool {
+	for _, rule := range rules {
+		if h, _, err := net.SplitHostPort(rule); err == nil {
+			rule = h
+		}
+		if _, _, err := net.ParseCIDR(rule); err == nil || net.ParseIP(rule) != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowed 目标地址是否匹配访问规则，域名目标只匹配域名规则。
+func (s *SOCKS5Server) allowed(dest string) bool {
+	for _, rule := range s.Deny {
+		if matchDest(rule, dest) {
+			return false
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, rule := range s.Allow {
+		if matchDest(rule, dest) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDest 目标地址 dest（host:port）是否匹配规则。
+func matchDest(rule, dest string) bool {
+	host, port, _ := net.SplitHostPort(dest)
+	rhost, rport := rule, ""
+	if h, p, err := net.SplitHostPort(rule); err == nil {
+		rhost, rport = h, p
+	}
+	if rport != "" && rport != port {
+		return false
+	}
+
+	if _, cidr, err := net.ParseCIDR(rhost); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && cidr.Contains(ip)
+	}
+	if ip := net.ParseIP(rhost); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	if suffix, ok := strings.CutPrefix(rhost, "*."); ok {
+		return strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(suffix))
+	}
+
+	return strings.EqualFold(rhost, host)
+}
+
+// socksUDPRelay UDP ASSOCIATE 的转发，每个目标地址建立一个流，每个数据报对应一个 websocket 消息。
+type socksUDPRelay struct {
+	srv     *SOCKS5Server
+	pc      net.PacketConn
+	client  net.IP
+	mutex   sync.Mutex
+	targets map[string]*socksTarget
+	closed  bool
+	wmu     sync.Mutex
+	peer    atomic.Pointer[net.UDPAddr] // 客户端的 UDP 地址
+}
+
+// socksTarget UDP 目标的流，ws 为 nil 代表流正在建立，期间的数据报缓存在 queue 中。
+type socksTarget struct {
+	ws    *websocket.Conn
+	queue [][]byte
+}
+
+func (ur *socksUDPRelay) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := ur.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || !udpAddr.IP.Equal(ur.client) { // 只接受控制连接的客户端发来的数据报
+			continue
+		}
+		ur.peer.Store(udpAddr)
+
+		// +----+------+------+----------+----------+----------+
+		// |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+		// +----+------+------+----------+----------+----------+
+		if n < 4 || buf[2] != 0 { // 不支持分片
+			continue
+		}
+		rd := bufio.NewReader(strings.NewReader(string(buf[3:n])))
+		dest, err := readSocksAddr(rd)
+		if err != nil {
+			continue
+		}
+		data, _ := io.ReadAll(rd)
+		ur.send(dest, data)
+	}
+}
+
+// send 发送数据报，目标的流不存在时在后台建立，不阻塞其它目标的转发。
+func (ur *socksUDPRelay) send(dest string, data []byte) {
+	st := ur.srv.stat(dest)
+	ur.mutex.Lock()
+	tgt := ur.targets[dest]
+	switch {
+	case tgt == nil:
+		tgt = &socksTarget{queue: [][]byte{data}}
+		ur.targets[dest] = tgt
+		ur.mutex.Unlock()
+		go ur.open(dest, tgt, st)
+		return
+	case tgt.ws == nil:
+		if len(tgt.queue) < socksMaxQueue {
+			tgt.queue = append(tgt.queue, data)
+		}
+		ur.mutex.Unlock()
+		return
+	}
+	ws := tgt.ws
+	ur.mutex.Unlock()
+
+	ur.write(ws, data, st)
+}
+
+// open 建立到目标的流并发送缓存的数据报。
+func (ur *socksUDPRelay) open(dest string, tgt *socksTarget, st *socksStat) {
+	target, ok := ur.srv.check(dest)
+	if !ok {
+		st.rejected.Add(1)
+	}
+	var ws *websocket.Conn
+	if ok {
+		var err error
+		if ws, err = dialRelay(context.Background(), ur.srv.tun, "udp", target); err != nil {
+			st.failed.Add(1)
+		}
+	}
+
+	ur.mutex.Lock()
+	if ws == nil || ur.closed {
+		delete(ur.targets, dest)
+		ur.mutex.Unlock()
+		if ws != nil {
+			_ = ws.Close()
+		}
+		return
+	}
+	st.conns.Add(1)
+	queue := tgt.queue
+	tgt.ws, tgt.queue = ws, nil
+	ur.mutex.Unlock()
+
+	go ur.receive(dest, ws, st)
+	for _, data := range queue {
+		ur.write(ws, data, st)
+	}
+}
+
+func (ur *socksUDPRelay) write(ws *websocket.Conn, data []byte, st *socksStat) {
+	ur.wmu.Lock()
+	err := ws.WriteMessage(websocket.BinaryMessage, data)
+	ur.wmu.Unlock()
+	if err == nil {
+		st.sent.Add(int64(len(data)))
+	}
+}
+
+func (ur *socksUDPRelay) receive(dest string, ws *websocket.Conn, st *socksStat) {
+	defer func() {
+		_ = ws.Close()
+		ur.mutex.Lock()
+		if tgt := ur.targets[dest]; tgt != nil && tgt.ws == ws {
+			delete(ur.targets, dest)
+		}
+		ur.mutex.Unlock()
+	}()
+
+	idle := ur.srv.UDPIdleTimeout
+	if idle <= 0 {
+		idle = time.Minute
+	}
+	head := socksAddrBytes(dest)
+	for {
+		_ = ws.SetReadDeadline(time.Now().Add(idle))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		peer := ur.peer.Load()
+		if peer == nil {
+			continue
+		}
+		pkt := append([]byte{0, 0, 0}, head...)
+		pkt = append(pkt, data...)
+		if _, err = ur.pc.WriteTo(pkt, peer); err != nil {
+			return
+		}
+		st.received.Add(int64(len(data)))
+	}
+}
+
+func (ur *socksUDPRelay) close() {
+	_ = ur.pc.Close()
+	ur.mutex.Lock()
+	defer ur.mutex.Unlock()
+	ur.closed = true
+	for _, tgt := range ur.targets {
+		if tgt.ws != nil {
+			_ = tgt.ws.Close()
+		}
+	}
+}
+
+// readSocksAddr 读取 ATYP | ADDR | PORT，返回 host:port。
+func readSocksAddr(rd *bufio.Reader) (string, error) {
+	atyp, err := rd.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if atyp == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make(net.IP, size)
+		if _, err = io.ReadFull(rd, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		size, exx := rd.ReadByte()
+		if exx != nil {
+			return "", exx
+		}
+		domain := make([]byte, size)
+		if _, err = io.ReadFull(rd, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", errors.New("不支持的地址类型")
+	}
+
+	port := make([]byte, 2)
+	if _, err = io.ReadFull(rd, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksAddrBytes 将 host:port 编码为 ATYP | ADDR | PORT。
+func socksAddrBytes(hostport string) []byte {
+	host, sport, _ := net.SplitHostPort(hostport)
+	port, _ := strconv.Atoi(sport)
+
+	var buf []byte
+	if ip := net.ParseIP(host); ip == nil {
+		buf = append(buf, socksAtypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socksAtypIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socksAtypIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
+}
+
+// writeSocksReply 写入应答，bind 为 nil 时使用 0.0.0.0:0。
+func writeSocksReply(w io.Writer, code byte, bind net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bind != nil {
+		addr = bind.String()
+	}
+	reply := append([]byte{0x05, code, 0x00}, socksAddrBytes(addr)...)
+	_, err := w.Write(reply)
+
+	return err
+}
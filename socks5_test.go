@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestSOCKS5StatsLimit(t *testing.T) {
+	srv := NewSOCKS5Server(nil)
+	for i := 0; i < socksMaxStats+10; i++ {
+		srv.stat("10.0.0.1:" + strconv.Itoa(i+1))
+	}
+	stats := srv.Stats()
+	if n := len(stats); n != socksMaxStats {
+		t.Fatalf("统计的目标数应不超过 %d，实际 %d", socksMaxStats, n)
+	}
+	if _, ok := stats["10.0.0.1:"+strconv.Itoa(socksMaxStats+10)]; !ok {
+		t.Fatal("最近访问的目标不应被淘汰")
+	}
+}
+
+func TestSOCKS5Authenticate(t *testing.T) {
+	srv := &SOCKS5Server{Users: map[string]string{"ops": "secret", "dev": "passwd"}}
+	for _, tc := range []struct {
+		user, passwd string
+		ok           bool
+	}{
+		{"ops", "secret", true},
+		{"dev", "passwd", true},
+		{"ops", "passwd", false},
+		{"nobody", "secret", false},
+		{"", "", false},
+	} {
+		if ok := srv.authenticate([]byte(tc.user), []byte(tc.passwd)); ok != tc.ok {
+			t.Fatalf("%s/%s 期望 %v，实际 %v", tc.user, tc.passwd, tc.ok, ok)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// State 通道连接状态。
+type State int32
+
+const (
+	// StateIdle 尚未开始连接。
+	StateIdle State = iota
+
+	// StateDialing 正在连接 broker（包含 TCP/TLS 连接与握手认证）。
+	StateDialing
+
+	// StateConnected 已连接。
+	StateConnected
+
+	// StateBackoff 连接失败，正在退避等待下次重试。
+	StateBackoff
+
+	// StateDisconnected 连接已断开，即将重连。
+	StateDisconnected
+
+	// StateShutdown 通道已关闭，不会再重连。
+	StateShutdown
+)
+
+// String fmt.Stringer
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateDialing:
+		return "dialing"
+	case StateConnected:
+		return "connected"
+	case StateBackoff:
+		return "backoff"
+	case StateDisconnected:
+		return "disconnected"
+	case StateShutdown:
+		return "shutdown"
+	default:
+		return "unknown"
+	}
+}
+
+// StateEvent 通道状态变更事件。
+type StateEvent struct {
+	From State     `json:"from"` // 变更前的状态
+	To   State     `json:"to"`   // 变更后的状态
+	At   time.Time `json:"at"`   // 变更时间
+	Addr *Address  `json:"addr"` // 相关的 broker 地址，可能为 nil
+	Err  error     `json:"-"`    // 导致状态变更的错误，可能为 nil
+}
+
+// stateMachine 维护通道连接状态并向订阅者广播状态变更。
+type stateMachine struct {
+	mutex sync.Mutex
+	last  StateEvent
+	subs  map[chan StateEvent]struct{}
+	done  chan struct{} // 进入 StateShutdown 后关闭
+}
+
+// State 当前状态。
+func (sm *stateMachine) State() State {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	return sm.last.To
+}
+
+// Subscribe 订阅状态变更事件。
+//
+// 订阅成功后首先会收到一个 From 与 To 相同的事件，代表订阅时的当前状态。
+// 当 ctx 结束或者通道进入 StateShutdown 后 channel 会被关闭。
+// 如果订阅者消费过慢导致缓冲区已满，会丢弃最旧的事件，保证订阅者总能拿到最新状态。
+func (sm *stateMachine) Subscribe(ctx context.Context) <-chan StateEvent {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ch := make(chan StateEvent, 16)
+	sm.mutex.Lock()
+	last := sm.last
+	last.From = last.To
+	ch <- last
+	if last.To == StateShutdown {
+		sm.mutex.Unlock()
+		close(ch)
+		return ch
+	}
+	if sm.subs == nil {
+		sm.subs = make(map[chan StateEvent]struct{}, 4)
+		sm.done = make(chan struct{})
+	}
+	sm.subs[ch] = struct{}{}
+	done := sm.done
+	sm.mutex.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		sm.mutex.Lock()
+		if _, ok := sm.subs[ch]; ok {
+			delete(sm.subs, ch)
+			close(ch)
+		}
+		sm.mutex.Unlock()
+	}()
+
+	return ch
+}
+
+// transit 状态变更。
+func (sm *stateMachine) transit(to State, addr *Address, err error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	from := sm.last.To
+	if from == StateShutdown {
+		return
+	}
+	evt := StateEvent{From: from, To: to, At: time.Now(), Addr: addr, Err: err}
+	sm.last = evt
+
+	for ch := range sm.subs {
+		select {
+		case ch <- evt:
+		default:
+			select { // 缓冲区已满，丢弃最旧的事件
+			case <-ch:
+			default:
+			}
+			ch <- evt
+		}
+		if to == StateShutdown {
+			delete(sm.subs, ch)
+			close(ch)
+		}
+	}
+	if to == StateShutdown && sm.done != nil {
+		close(sm.done)
+	}
+}
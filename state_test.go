@@ -0,0 +1,65 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStateMachine(t *testing.T) {
+	sm := new(stateMachine)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := sm.Subscribe(ctx)
+	if evt := <-ch; evt.From != StateIdle || evt.To != StateIdle {
+		t.Fatalf("订阅后第一个事件应为当前状态，实际 %s -> %s", evt.From, evt.To)
+	}
+
+	addr := &Address{Addr: "127.0.0.1:443", TLS: true}
+	sm.transit(StateDialing, nil, nil)
+	sm.transit(StateConnected, addr, nil)
+	if evt := <-ch; evt.To != StateDialing {
+		t.Fatalf("期望 %s，实际 %s", StateDialing, evt.To)
+	}
+	if evt := <-ch; evt.From != StateDialing || evt.To != StateConnected || evt.Addr != addr {
+		t.Fatalf("状态变更事件不正确：%+v", evt)
+	}
+	if st := sm.State(); st != StateConnected {
+		t.Fatalf("期望 %s，实际 %s", StateConnected, st)
+	}
+
+	exx := errors.New("closed")
+	sm.transit(StateShutdown, nil, exx)
+	if evt := <-ch; evt.To != StateShutdown || evt.Err != exx {
+		t.Fatalf("状态变更事件不正确：%+v", evt)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("通道关闭后订阅应被关闭")
+	}
+
+	sm.transit(StateDialing, nil, nil)
+	if st := sm.State(); st != StateShutdown {
+		t.Fatalf("关闭后状态不应再变更，实际 %s", st)
+	}
+}
+
+func TestStateMachineOverflow(t *testing.T) {
+	sm := new(stateMachine)
+	ch := sm.Subscribe(context.Background())
+	<-ch
+
+	for i := 0; i < 100; i++ {
+		sm.transit(StateDialing, nil, nil)
+		sm.transit(StateBackoff, nil, nil)
+	}
+	sm.transit(StateConnected, nil, nil)
+
+	var last StateEvent
+	for len(ch) != 0 {
+		last = <-ch
+	}
+	if last.To != StateConnected {
+		t.Fatalf("缓冲区溢出时应保留最新的事件，实际 %s", last.To)
+	}
+}
@@ -0,0 +1,119 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+)
+
+// TLSPolicy broker TLS 连接策略。
+type TLSPolicy struct {
+	// Config TLS 基础配置，每次连接时都会复制一份使用，可以设置私有 CA（RootCAs）、
+	// 客户端证书（Certificates）、最低 TLS 版本（MinVersion）等。
+	// 设置了 RootCAs 后只信任其中的 CA，不再信任系统根证书。
+	// ServerName 为空时会自动填充为 Address.Name 或者地址的主机名。
+	// 为 nil 时使用系统根证书校验。
+	Config *tls.Config
+
+	// Pins 公钥指纹集合（见 PinSHA256），不为空时校验通过的证书链中至少有一个证书的公钥
+	// 与之匹配才允许连接。即使 Config.InsecureSkipVerify 为 true 依然会校验指纹，
+	// 此时没有经过校验的证书链，只匹配 broker 自身的证书（对端发送的第一个证书）。
+	Pins []string
+
+	// Verify 自定义校验，在证书链校验与公钥指纹校验通过后调用，返回 error 则拒绝连接。
+	Verify func(cs tls.ConnectionState, addr *Address) error
+}
+
+// PinSHA256 计算证书公钥（SubjectPublicKeyInfo）的 SHA-256 指纹，格式为 base64，
+// 与 HPKP 的 pin-sha256 格式一致，可以通过如下命令计算：
+//
+//	openssl x509 -in broker.pem -pubkey -noout |
+//		openssl pkey -pubin -outform der |
+//		openssl dgst -sha256 -binary | base64
+func PinSHA256(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ErrPinMismatch broker 证书公钥与 TLSPolicy.Pins 均不匹配。
+var ErrPinMismatch = errors.New("broker 证书公钥指纹不匹配")
+
+// tlsPolicies 全局与按地址配置的 TLS 策略。
+type tlsPolicies struct {
+	global TLSPolicy
+	addrs  map[string]TLSPolicy // key 为 broker 地址 host:port 或 host
+}
+
+// config 生成连接 addr 所用的 TLS 配置。
+func (tp *tlsPolicies) config(addr *Address) *tls.Config {
+	policy := tp.global
+	if tp.addrs != nil {
+		host, _ := splitHostPort(addr.Addr)
+		if p, ok := tp.addrs[addr.Addr]; ok {
+			policy = p
+		} else if p, ok = tp.addrs[host]; ok {
+			policy = p
+		}
+	}
+
+	var cfg *tls.Config
+	if policy.Config != nil {
+		cfg = policy.Config.Clone()
+	} else {
+		cfg = new(tls.Config)
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = addr.Name
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _ = splitHostPort(addr.Addr)
+	}
+	if len(policy.Pins) == 0 && policy.Verify == nil {
+		return cfg
+	}
+
+	pins := make(map[string]struct{}, len(policy.Pins))
+	for _, pin := range policy.Pins {
+		pins[pin] = struct{}{}
+	}
+	verify, next := policy.Verify, cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		if len(pins) != 0 && !matchPins(cs, pins) {
+			return ErrPinMismatch
+		}
+		if verify != nil {
+			return verify(cs, addr)
+		}
+		return nil
+	}
+
+	return cfg
+}
+
+// matchPins 校验公钥指纹。PeerCertificates 是对端发送的原始列表，攻击者可以在自己的证书后
+// 附加真实 broker 的证书，所以只匹配校验通过的证书链；跳过了证书链校验时只匹配叶子证书。
+func matchPins(cs tls.ConnectionState, pins map[string]struct{}) bool {
+	if len(cs.VerifiedChains) == 0 {
+		return len(cs.PeerCertificates) != 0 && hasPin(cs.PeerCertificates[0], pins)
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if hasPin(cert, pins) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasPin(cert *x509.Certificate, pins map[string]struct{}) bool {
+	_, ok := pins[PinSHA256(cert)]
+	return ok
+}
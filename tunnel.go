@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -65,82 +66,81 @@ type Tunneler interface {
 
 	// Doer 发送请求
 	//
-	// Deprecated: 请基于 DialContext 包装一个 http.Client。
+	// Deprecated: 请使用 HTTPClient。
 	// 	示例：
-	//		cli := &http.Client{
-	//			Transport: &http.Transport{
-	//				DialContext: tun.DialContext,
-	//			},
-	//		}
-	//
-	//		cli.Do(req)
+	//		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://soc/api/v1/...", nil)
+	//		tun.HTTPClient().Do(req)
 	Doer(prefix string) Doer
 
 	// Fetch 请求响应式调用
 	//
-	// Deprecated: 请基于 DialContext 包装一个 http.Client。
+	// Deprecated: 请使用 HTTPClient。
 	// 	示例：
-	//		cli := &http.Client{
-	//			Transport: &http.Transport{
-	//				DialContext: tun.DialContext,
-	//			},
-	//		}
-	//
-	//		cli.Do(req)
+	//		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://soc/api/v1/...", body)
+	//		tun.HTTPClient().Do(req)
 	Fetch(context.Context, string, io.Reader, http.Header) (*http.Response, error)
 
 	// Oneway 单向调用，不在乎返回值
+	// 通过 WithOutbox 开启离线队列后，通道断开期间以及 broker 响应 5xx 的上报会入队并在稍后重放。
 	//
-	// Deprecated: 请基于 DialContext 包装一个 http.Client。
+	// Deprecated: 请使用 HTTPClient，注意 HTTPClient 的请求不会进入离线队列。
 	// 	示例：
-	//		cli := &http.Client{
-	//			Transport: &http.Transport{
-	//				DialContext: tun.DialContext,
-	//			},
+	//		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://soc/api/v1/...", body)
+	//		res, err := tun.HTTPClient().Do(req)
+	//		if err == nil {
+	//			res.Body.Close()
 	//		}
-	//
-	//		cli.Do(req)
 	Oneway(context.Context, string, io.Reader, http.Header) error
 
 	// JSON 请求与响应均为 json
 	//
-	// Deprecated: 请基于 DialContext 包装一个 http.Client。
+	// Deprecated: 请使用 HTTPClient。
 	// 	示例：
-	//		cli := &http.Client{
-	//			Transport: &http.Transport{
-	//				DialContext: tun.DialContext,
-	//			},
+	//		buf, _ := json.Marshal(data)
+	//		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://soc/api/v1/...", bytes.NewReader(buf))
+	//		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	//		res, err := tun.HTTPClient().Do(req)
+	//		if err == nil {
+	//			defer res.Body.Close()
+	//			err = json.NewDecoder(res.Body).Decode(&resp)
 	//		}
-	//
-	//		cli.Do(req)
 	JSON(context.Context, string, any, any) error
 
 	// OnewayJSON 请求数据格式化为 json 后发送，不关心不解析返回数据
+	// 通过 WithOutbox 开启离线队列后，通道断开期间以及 broker 响应 5xx 的上报会入队并在稍后重放。
 	//
-	// Deprecated: 请基于 DialContext 包装一个 http.Client。
+	// Deprecated: 请使用 HTTPClient，注意 HTTPClient 的请求不会进入离线队列。
 	// 	示例：
-	//		cli := &http.Client{
-	//			Transport: &http.Transport{
-	//				DialContext: tun.DialContext,
-	//			},
+	//		buf, _ := json.Marshal(data)
+	//		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://soc/api/v1/...", bytes.NewReader(buf))
+	//		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	//		res, err := tun.HTTPClient().Do(req)
+	//		if err == nil {
+	//			res.Body.Close()
 	//		}
-	//
-	//		cli.Do(req)
 	OnewayJSON(context.Context, string, any) error
 
-	// Attachment 文件附件下载
+	// Attachment 文件附件下载，下载大文件请使用 DownloadFile。
 	//
-	// Deprecated: 请基于 DialContext 包装一个 http.Client。
+	// Deprecated: 请使用 HTTPClient。
 	// 	示例：
-	//		cli := &http.Client{
-	//			Transport: &http.Transport{
-	//				DialContext: tun.DialContext,
-	//			},
-	//		}
-	//
-	//		cli.Do(req)
+	//		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://soc/api/v1/...", nil)
+	//		tun.HTTPClient().Do(req)
 	Attachment(context.Context, string, ...time.Duration) (*Attachment, error)
 
+	// DownloadFile 下载 broker 上的文件 path 并保存至 dest，适用于升级包等大文件。
+	//
+	// 文件先写入临时文件 dest + ".download"，下载过程中通道断开时会等待重连，
+	// 然后通过 HTTP Range 请求续传。下载完毕后如果响应的 Content-Disposition 中有 hash 参数，
+	// 会校验文件的 MD5，校验不一致时删除临时文件并返回 ErrChecksum，校验通过后原子地重命名为 dest。
+	// 没有 hash 参数时默认不校验，指定了 RequireChecksum 时删除临时文件并返回 ErrNoChecksum。
+	// broker 响应了非预期的状态码（*netutil.HTTPError）时同样会删除临时文件；其它原因导致下载失败时
+	// 会保留临时文件以及记录远端文件版本的 dest + ".download.meta"，下次调用时会从中断处续传，
+	// 没有可用于判断远端文件是否变化的版本记录时从头下载。
+	//
+	// 下载没有默认的超时时间，请通过 ctx 控制；progress 可以为 nil。
+	DownloadFile(ctx context.Context, path, dest string, progress DownloadProgress, opts ...DownloadOption) error
+
 	// Stream 建立双向流
 	//
 	// Deprecated: 请基于 DialContext 自行实现。
@@ -151,16 +151,146 @@ type Tunneler interface {
 	// Deprecated: 请基于 DialContext 自行实现。
 	StreamConn(ctx context.Context, path string, header http.Header) (net.Conn, error)
 
+	// DialContext 在通道上打开一个新的流，network 与 addr 参数会被忽略。
+	// 通道未连接时的等待策略见 WithDialWait。
 	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// HTTPClient 经由通道访问 broker 接口的 HTTP 客户端，请求地址的 Host 部分会被忽略，
+	// 通常写作 http://soc/api/v1/...。
+	//
+	// 会话变更（断开或重连成功）时会清空连接池中的空闲连接，避免复用已失效会话上的流；
+	// 幂等请求（GET、HEAD、OPTIONS、TRACE、PUT、DELETE 或携带 Idempotency-Key 首部）
+	// 在请求过程中会话断开时会等待重连成功后自动重试一次。客户端没有设置整体超时，请通过请求的 ctx 控制。
+	HTTPClient() *http.Client
+
+	// Listener 返回接收 broker 发起的流的监听器，多次调用返回同一个监听器。
+	//
+	// 与会话绑定的监听器不同，该监听器在断开重连期间依然有效，Accept 会阻塞等待
+	// 重连成功后的新流，只有关闭监听器或通道关闭后才会返回 net.ErrClosed。
+	// 因此可以在 broker 发起的流上运行任意协议（gRPC、自定义的二进制 RPC 等），
+	// 返回的连接都是 *BrokerConn，可以获取流的元数据。
+	//
+	// 如果 Dial 时 Server 参数为 nil，调用该方法后默认的 404 服务将不再接收流；
+	// 如果传入了 Server，则两者会共同接收（争抢）broker 发起的流，通常不应同时使用。
+	Listener() net.Listener
+
+	// Forward 将本地 TCP 地址 localAddr 经由 broker 转发至 remoteAddr，阻塞直至 ctx 结束
+	// 或者通道关闭，通道断开期间会关闭本地监听，重连后自动重新监听。
+	// 需要转发 UDP、多个端口或者统计流量时请使用 NewForwarder。
+	Forward(ctx context.Context, localAddr, remoteAddr string) error
+
+	// Outbox 离线上报队列，未通过 WithOutbox 开启时返回 nil（nil 队列的 Stats 与 Len 返回零值）。
+	// 可以通过 Outbox().Stats() 监控队列深度。
+	Outbox() *Outbox
+
+	// Heartbeat 心跳控制器，可以获取心跳的往返时延、丢失率等统计数据，
+	// 也可以在运行期间调整心跳间隔或者立即发送一次心跳。
+	Heartbeat() *Heartbeat
+
+	// Services agent 本地服务注册表，broker 可以通过名称访问其中注册的本地服务（反向端口转发），
+	// 使用方法见 ServicePreface。
+	Services() *ServiceRegistry
+
+	// State 当前连接状态。
+	State() State
+
+	// Subscribe 订阅连接状态变更事件，可用于健康检查、界面展示通道的实时状态。
+	// 订阅后首先会收到一个代表当前状态的事件（From 与 To 相同），之后每次状态
+	// 变更都会收到一个事件。当 ctx 结束或通道关闭（StateShutdown）后 channel 会被关闭。
+	//
+	// 事件是异步投递的，消费过慢时会丢弃最旧的事件，不会阻塞通道的连接流程。
+	Subscribe(ctx context.Context) <-chan StateEvent
+
+	// Shutdown 优雅关闭通道：停止重连与心跳，不再接收 broker 发起的新流，
+	// 调用 Server 的 Shutdown 方法（如果实现了的话），等待已建立的流和 HTTP
+	// 请求处理完毕直至 ctx 结束，最后断开连接并通知 Notifier.Shutdown。
+	// Notifier.Shutdown 只会被通知一次。
+	Shutdown(ctx context.Context) error
+
+	// Close 立即关闭通道，不等待未完成的流。
+	Close() error
 }
 
+// Server 处理 broker 发起的请求。
+//
+// Serve 只会被调用一次，传入的监听器在断开重连期间依然有效，接收到的连接都是 *BrokerConn。
+// 需要在一个通道上同时承载 HTTP 与其它协议时可以使用 Mux。
+//
+// 如果 Server 实现了 Shutdown(context.Context) error（如 net/http）或
+// Shutdown() error（如 fasthttp）方法，Tunneler.Shutdown 时会调用之，
+// 实现了 Close() error 方法则在 Tunneler.Close 时调用之。
 type Server interface {
 	Serve(ln net.Listener) error
 }
 
+// ErrTunnelClosed 调用了 Tunneler.Shutdown 或 Tunneler.Close 主动关闭了通道。
+var ErrTunnelClosed = errors.New("通道已关闭")
+
+// ErrDisconnected 通道当前未连接。
+var ErrDisconnected = errors.New("通道未连接")
+
 // Dial 建立与服务端的通道连接。
 // 如果有网络不可达问题，该方法会一直重连直至成功，或者遇到不可重试的错误。
+//
+// 取消 parent 等同于调用 Tunneler.Close，区别是 Notifier.Shutdown 收到的是 parent.Err()
+// 而不是 ErrTunnelClosed。Dial 返回错误时不会通知 Notifier.Shutdown。
 func Dial(parent context.Context, hide definition.MHide, srv Server, opts ...Option) (Tunneler, error) {
+	bt, err := newTunnel(parent, hide, srv, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = bt.dial(); err != nil {
+		// 通道没有返回给调用方，不应该再通知 Notifier.Shutdown（包括正在执行的 AfterFunc）。
+		bt.notified.Store(true)
+		bt.unwatch()
+		bt.quit()
+		close(bt.done)
+		if bt.outbox != nil {
+			_ = bt.outbox.Close()
+		}
+		bt.slog.Infof("连接 broker 失败：%v", err)
+		bt.state.transit(StateShutdown, nil, err)
+		return nil, err
+	}
+	bt.start()
+
+	return bt, nil
+}
+
+// DialAsync 非阻塞式建立与服务端的通道连接，该方法会立即返回，连接在后台进行。
+//
+// 在首次连接成功之前，Tunneler.DialContext 默认会等待连接成功或者 ctx 结束，
+// 可以通过 WithDialWait 修改等待策略。首次连接成功后依然会通知 Notifier.Connected；
+// 如果遇到不可重试的错误，会通知 Notifier.Shutdown，可以通过 Tunneler.State 或
+// Tunneler.Subscribe 观察连接状态。
+//
+// 返回的 error 仅代表参数错误。
+func DialAsync(parent context.Context, hide definition.MHide, srv Server, opts ...Option) (Tunneler, error) {
+	opts = append([]Option{WithDialWait(math.MaxInt64)}, opts...)
+	bt, err := newTunnel(parent, hide, srv, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		if exx := bt.dial(); exx != nil {
+			close(bt.done)
+			if bt.parent.Err() != nil {
+				return // 调用了 Shutdown/Close，由其负责通知
+			}
+			bt.quit()
+			bt.slog.Infof("连接 broker 失败：%v", exx)
+			bt.notifyShutdown(exx)
+			return
+		}
+		bt.start()
+	}()
+
+	return bt, nil
+}
+
+func newTunnel(parent context.Context, hide definition.MHide, srv Server, opts []Option) (*borerTunnel, error) {
 	addrs := hide.Addrs
 	if len(addrs) == 0 {
 		return nil, errors.New("地址不能为空")
@@ -169,6 +299,8 @@ func Dial(parent context.Context, hide definition.MHide, srv Server, opts ...Opt
 	if parent == nil {
 		parent = context.Background()
 	}
+	root := parent
+	parent, quit := context.WithCancel(parent)
 
 	opt := new(option)
 	for _, fn := range opts {
@@ -186,17 +318,46 @@ func Dial(parent context.Context, hide definition.MHide, srv Server, opts ...Opt
 	if opt.ident == nil {
 		opt.ident = NewMachineID(".ssoc-machine-id")
 	}
+	if opt.backoff == nil {
+		opt.backoff = NewLadderBackoff()
+	}
+	if opt.stable <= 0 {
+		opt.stable = time.Minute
+	}
+	if opt.selector == nil {
+		opt.selector = NewRoundRobinSelector()
+	}
 	// 心跳间隔小于等于 0 时代表关闭定时心跳，此时中心端不会对该节点定期心跳监控。
 	// 如果该值大于 0，则有效值在 1min - 20min 之间，如果参数不在有效区间则自动改为 1min。
 	// 如果设置了心跳，服务端 3 倍心跳间隔仍未收到该节点的任何数据包，则会强制断开 socket 连接。
 	// 客户端发送心跳如果连续 n 次错误，也会自己主动断开连接。
-	// 具体 n 是几，可以查看 borerTunnel.heartbeat 方法中的定义。
+	// 具体 n 是几，可以查看 heartbeatFailures 的定义。
 	if opt.interval > 0 && (opt.interval < time.Minute || opt.interval > 20*time.Minute) {
 		opt.interval = time.Minute
 	}
+	mux, err := opt.mux.smuxConfig()
+	if err != nil {
+		quit()
+		return nil, err
+	}
+	var outbox *Outbox
+	if opt.outbox != nil {
+		if outbox, err = OpenOutbox(*opt.outbox); err != nil {
+			quit()
+			return nil, err
+		}
+	}
+	hub := newStreamHub()
+	var fallback *hubListener
+	if srv == nil {
+		srv = &http.Server{
+			Handler: http.NotFoundHandler(),
+		}
+		fallback = hub.listen()
+	}
 
 	// 对地址预先处理
-	dial := newDialer(addrs, hide.Servername)
+	dial := newDialer(addrs, hide.Servername, opt)
 	bt := &borerTunnel{
 		hide:     hide,
 		dialer:   dial,
@@ -204,36 +365,53 @@ func Dial(parent context.Context, hide definition.MHide, srv Server, opts ...Opt
 		mident:   opt.ident,
 		slog:     opt.slog,
 		coder:    opt.coder,
-		interval: opt.interval,
+		backoff:  opt.backoff,
+		stable:   opt.stable,
+		wait:     opt.wait,
+		mux:      *mux,
+		srv:      srv,
+		hub:      hub,
+		services: NewServiceRegistry(),
+		outbox:   outbox,
+		fallback: fallback,
 		parent:   parent,
+		quit:     quit,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
 	}
 	bt.ident = bt.initIdent(hide)
-	bt.ident.Interval = bt.interval
+	bt.heart = newHeartbeat(bt, opt.interval, opt.probe, opt.payload)
+	bt.ident.Interval = opt.interval
 	bt.ident.MachineID = bt.mident.MachineID(false)
 
 	bt.stream = netutil.NewStream(bt.dialContext)        // 创建 stream 连接器
 	trip := &http.Transport{DialContext: bt.dialContext} // 创建 HTTP 客户端
+	bt.trip = trip
 	bt.client = netutil.NewClient(trip)
+	bt.httpCli, bt.httpTrip = newHTTPClient(bt)
 
-	if err := bt.dial(); err != nil {
-		bt.slog.Infof("连接 broker 失败：%v", err)
-		return nil, err
-	}
+	// 兼容以前的用法：取消 Dial 传入的 context 时关闭通道，
+	// 与以前一样 Notifier.Shutdown 收到的是 ctx.Err()。
+	bt.unwatch = context.AfterFunc(root, func() {
+		_ = bt.shutdown(context.Background(), false, root.Err())
+	})
 
-	// 连接成功后是否开启心跳
-	if du := bt.interval; du > 0 { // 是否开启心跳
-		go bt.heartbeat(du)
-	}
+	return bt, nil
+}
+
+// start 首次连接成功后开启心跳与监听。
+func (bt *borerTunnel) start() {
+	// 连接成功后开启心跳，心跳间隔为 0 时暂停，可以通过 Heartbeat().SetInterval 开启
+	go bt.heart.run()
 
 	// 开启监听
-	if srv == nil {
-		srv = &http.Server{
-			Handler: http.NotFoundHandler(),
-		}
+	ln := bt.fallback
+	if ln == nil {
+		ln = bt.hub.listen()
 	}
-	go bt.serveHTTP(srv)
-
-	return bt, nil
+	go bt.serve(ln)
+	go bt.guard()
+	go bt.replay() // 发送上次运行遗留的离线上报
 }
 
 func (bt *borerTunnel) initIdent(hide definition.MHide) Ident {
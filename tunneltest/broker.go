@@ -0,0 +1,371 @@
+// Package tunneltest 提供一个进程内的模拟 broker，用于端到端测试 agent 节点。
+//
+// 模拟 broker 监听本地 TCP 端口（同一个端口同时支持 TLS 和明文），应答
+// CONNECT /api/v1/minion 握手：解密 tunnel.Ident 并返回加密后的 tunnel.Issue，
+// 握手成功后在该连接上运行 smux 服务端。测试代码既可以通过 Handler 模拟 broker
+// 提供的接口，也可以通过 Session.Client 回调 agent 的 tunnel.Server。
+package tunneltest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vela-ssoc/vela-common-mba/ciphertext"
+	"github.com/vela-ssoc/vela-common-mba/definition"
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+	"github.com/vela-ssoc/vela-common-mba/smux"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+// Servername 模拟 broker 的服务名称，自签名证书中包含该名称。
+const Servername = "broker.tunneltest"
+
+// HandshakeFunc 握手回调，可以用来模拟各种握手结果。
+//
+// 返回 *netutil.HTTPError 时，broker 会以 HTTPError.Code 作为状态码、
+// HTTPError.Body 作为报文响应，例如用 Reject(http.StatusConflict, "") 模拟机器码冲突，
+// 用 Reject(http.StatusNotAcceptable, "") 模拟节点已被删除（不可重试）。
+// 返回其它错误时以 400 响应。
+type HandshakeFunc func(ident tunnel.Ident) (tunnel.Issue, error)
+
+// Reject 构造一个握手拒绝的错误，配合 HandshakeFunc 使用。
+func Reject(code int, body string) error {
+	return &netutil.HTTPError{Code: code, Body: []byte(body)}
+}
+
+// Broker 模拟的 broker 节点。
+type Broker struct {
+	// Handler agent 通过通道调用 broker 接口的处理器。
+	// 为空时只应答 /api/v1/minion/ping 心跳，其余接口均返回 404。
+	Handler http.Handler
+
+	// Handshake 握手回调，为空时每次握手都成功，并分配自增的节点 ID 与随机密钥。
+	Handshake HandshakeFunc
+
+	// Sessions 握手成功的会话，在调用 Start 前可以修改缓冲区大小。
+	// 如果测试代码不消费，缓冲区满了之后新的会话不再投递。
+	Sessions chan *Session
+
+	ln       net.Listener
+	cert     tls.Certificate
+	leaf     *x509.Certificate
+	seq      atomic.Int64
+	mutex    sync.Mutex
+	conns    map[*Session]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	handled  atomic.Int64
+	attempts atomic.Int64
+}
+
+// NewBroker 创建并启动一个模拟 broker，h 为 agent 调用 broker 接口的处理器。
+func NewBroker(h http.Handler) *Broker {
+	brk := NewUnstartedBroker(h)
+	brk.Start()
+	return brk
+}
+
+// NewUnstartedBroker 创建一个未启动的模拟 broker，调用方可以在 Start 之前设置
+// Handshake 等字段。
+func NewUnstartedBroker(h http.Handler) *Broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if ln, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("tunneltest: 监听本地端口失败：" + err.Error())
+		}
+	}
+	cert, leaf := newCertificate()
+
+	return &Broker{
+		Handler:  h,
+		Sessions: make(chan *Session, 16),
+		ln:       ln,
+		cert:     cert,
+		leaf:     leaf,
+		conns:    make(map[*Session]struct{}, 4),
+	}
+}
+
+// Start 启动模拟 broker。
+func (brk *Broker) Start() {
+	if brk.Handler == nil {
+		brk.Handler = http.HandlerFunc(pingHandler)
+	}
+	brk.wg.Add(1)
+	go brk.serve()
+}
+
+// Addr 监听地址，例如 127.0.0.1:34567。
+func (brk *Broker) Addr() string {
+	return brk.ln.Addr().String()
+}
+
+// Hide 构造连接该 broker 所需的 definition.MHide。
+func (brk *Broker) Hide() definition.MHide {
+	return definition.MHide{
+		Servername: Servername,
+		Addrs:      []string{brk.Addr()},
+		Semver:     "0.0.1-tunneltest",
+	}
+}
+
+// Certificate broker 的自签名证书，TLS 连接时用于校验。
+func (brk *Broker) Certificate() *x509.Certificate {
+	return brk.leaf
+}
+
+// Attempts 收到的握手请求次数，包含失败的握手。
+func (brk *Broker) Attempts() int {
+	return int(brk.attempts.Load())
+}
+
+// Handled 握手成功的次数。
+func (brk *Broker) Handled() int {
+	return int(brk.handled.Load())
+}
+
+// CloseSessions 断开当前所有的会话，用于模拟网络中断或 broker 重启。
+func (brk *Broker) CloseSessions() {
+	brk.mutex.Lock()
+	sess := make([]*Session, 0, len(brk.conns))
+	for s := range brk.conns {
+		sess = append(sess, s)
+	}
+	brk.mutex.Unlock()
+
+	for _, s := range sess {
+		_ = s.Close()
+	}
+}
+
+// Close 关闭 broker 及其所有会话。
+func (brk *Broker) Close() error {
+	brk.mutex.Lock()
+	if brk.closed {
+		brk.mutex.Unlock()
+		return nil
+	}
+	brk.closed = true
+	brk.mutex.Unlock()
+
+	err := brk.ln.Close()
+	brk.CloseSessions()
+	brk.wg.Wait()
+
+	return err
+}
+
+func (brk *Broker) serve() {
+	defer brk.wg.Done()
+	for {
+		conn, err := brk.ln.Accept()
+		if err != nil {
+			return
+		}
+		brk.wg.Add(1)
+		go func() {
+			defer brk.wg.Done()
+			brk.serveConn(conn)
+		}()
+	}
+}
+
+func (brk *Broker) serveConn(conn net.Conn) {
+	rd := bufio.NewReader(conn)
+	if head, err := rd.Peek(1); err != nil {
+		_ = conn.Close()
+		return
+	} else if head[0] == 0x16 { // TLS ClientHello
+		cfg := &tls.Config{Certificates: []tls.Certificate{brk.cert}}
+		conn = tls.Server(&bufferedConn{Conn: conn, rd: rd}, cfg)
+		rd = bufio.NewReader(conn)
+	}
+
+	req, err := http.ReadRequest(rd)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	if req.Method != http.MethodConnect || req.URL.Path != "/api/v1/minion" {
+		_ = writeResponse(conn, http.StatusBadRequest, nil)
+		_ = conn.Close()
+		return
+	}
+	brk.attempts.Add(1)
+
+	enc, err := io.ReadAll(io.LimitReader(req.Body, 100*1024))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	var ident tunnel.Ident
+	if err = ciphertext.DecryptJSON(enc, &ident); err != nil {
+		_ = writeResponse(conn, http.StatusBadRequest, []byte(err.Error()))
+		_ = conn.Close()
+		return
+	}
+
+	issue, err := brk.handshake(ident)
+	if err != nil {
+		code, body := http.StatusBadRequest, []byte(err.Error())
+		var he *netutil.HTTPError
+		if errors.As(err, &he) {
+			code, body = he.Code, he.Body
+		}
+		_ = writeResponse(conn, code, body)
+		_ = conn.Close()
+		return
+	}
+	dat, err := ciphertext.EncryptJSON(issue)
+	if err != nil {
+		_ = writeResponse(conn, http.StatusInternalServerError, []byte(err.Error()))
+		_ = conn.Close()
+		return
+	}
+	if err = writeResponse(conn, http.StatusAccepted, dat); err != nil {
+		_ = conn.Close()
+		return
+	}
+	if rd.Buffered() != 0 {
+		conn = &bufferedConn{Conn: conn, rd: rd}
+	}
+
+	cfg := smux.DefaultConfig()
+	cfg.Passwd = issue.Passwd
+	mux := smux.Server(conn, cfg)
+	sess := newSession(ident, issue, mux)
+
+	brk.mutex.Lock()
+	if brk.closed {
+		brk.mutex.Unlock()
+		_ = mux.Close()
+		return
+	}
+	brk.conns[sess] = struct{}{}
+	brk.mutex.Unlock()
+	brk.handled.Add(1)
+
+	select {
+	case brk.Sessions <- sess:
+	default:
+	}
+
+	srv := &http.Server{Handler: brk.Handler}
+	_ = srv.Serve(mux)
+	_ = sess.Close()
+
+	brk.mutex.Lock()
+	delete(brk.conns, sess)
+	brk.mutex.Unlock()
+}
+
+func (brk *Broker) handshake(ident tunnel.Ident) (tunnel.Issue, error) {
+	if fn := brk.Handshake; fn != nil {
+		return fn(ident)
+	}
+
+	passwd := make([]byte, 16)
+	_, _ = rand.Read(passwd)
+	issue := tunnel.Issue{
+		ID:     brk.seq.Add(1),
+		Passwd: passwd,
+	}
+
+	return issue, nil
+}
+
+// Session 握手成功后 broker 与 agent 之间的会话。
+type Session struct {
+	Ident  tunnel.Ident // agent 握手时携带的认证信息
+	Issue  tunnel.Issue // broker 返回给 agent 的信息
+	mux    *smux.Session
+	client *http.Client
+}
+
+func newSession(ident tunnel.Ident, issue tunnel.Issue, mux *smux.Session) *Session {
+	sess := &Session{Ident: ident, Issue: issue, mux: mux}
+	trip := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			stream, err := mux.OpenStream()
+			if err != nil {
+				return nil, err
+			}
+			return stream, nil
+		},
+	}
+	sess.client = &http.Client{Transport: trip}
+
+	return sess
+}
+
+// Client 调用 agent 的 tunnel.Server 的 HTTP 客户端，请求的 Host 可以任意填写，
+// 例如：http://agent/api/v1/agent/startup
+func (s *Session) Client() *http.Client {
+	return s.client
+}
+
+// OpenStream 打开一个 broker 发起的原始流。
+func (s *Session) OpenStream() (net.Conn, error) {
+	stream, err := s.mux.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Done 会话断开时关闭。
+func (s *Session) Done() <-chan struct{} {
+	return s.mux.CloseChan()
+}
+
+// Close 断开会话。
+func (s *Session) Close() error {
+	s.client.CloseIdleConnections()
+	if s.mux.IsClosed() {
+		return nil
+	}
+	return s.mux.Close()
+}
+
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/api/v1/minion/ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func writeResponse(w io.Writer, code int, body []byte) error {
+	res := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+	}
+	if len(body) != 0 {
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	return res.Write(w)
+}
+
+// bufferedConn 读取时优先消费已经预读的数据。
+type bufferedConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(p []byte) (int, error) {
+	return bc.rd.Read(p)
+}
@@ -0,0 +1,737 @@
+package tunneltest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/definition"
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+type machineID struct {
+	rebuilds atomic.Int32
+}
+
+func (m *machineID) MachineID(rebuild bool) string {
+	if rebuild {
+		return "rebuild-" + string(rune('0'+m.rebuilds.Add(1)))
+	}
+	return "tunneltest"
+}
+
+// fastBackoff 测试时快速重试。
+type fastBackoff struct{}
+
+func (fastBackoff) Next() time.Duration { return 10 * time.Millisecond }
+func (fastBackoff) Reset()              {}
+
+func TestDial(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/echo", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	agent := http.NewServeMux()
+	agent.HandleFunc("/api/v1/agent/hello", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("hello broker"))
+	})
+	srv := &http.Server{Handler: agent}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), srv, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sess *Session
+	select {
+	case sess = <-brk.Sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待会话超时")
+	}
+	if sess.Ident.MachineID != "tunneltest" || sess.Issue.ID != tun.ID() {
+		t.Fatalf("会话信息不匹配：%s %s", sess.Ident.MachineID, sess.Issue)
+	}
+
+	var reply string
+	if err = tun.JSON(ctx, "/api/v1/broker/echo", "ping", &reply); err != nil || reply != "ping" {
+		t.Fatalf("调用 broker 接口失败：%v %q", err, reply)
+	}
+
+	res, err := sess.Client().Get("http://agent/api/v1/agent/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "hello broker" {
+		t.Fatalf("回调 agent 接口失败：%q", body)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	// 192.0.2.0/24 为 RFC 5737 保留的文档地址，通常是不可达的黑洞地址。
+	hide := brk.Hide()
+	hide.Addrs = append([]string{"192.0.2.1:443"}, hide.Addrs...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	tun, err := tunnel.Dial(ctx, hide, nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithHappyEyeballs(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	if du := time.Since(start); du > 2*time.Second {
+		t.Fatalf("竞速连接耗时过长：%s", du)
+	}
+	if got, want := tun.BrkAddr().Addr, brk.Addr(); got != want {
+		t.Fatalf("连接的 broker 地址不正确：%s != %s", got, want)
+	}
+}
+
+// 明文连接省去了 TLS 握手，竞速时也不能抢在 TLS 连接之前胜出。
+func TestDialHappyEyeballsPrefersTLS(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(brk.Certificate())
+	slow := func(tls.ConnectionState, *tunnel.Address) error {
+		time.Sleep(200 * time.Millisecond) // 模拟握手耗时远超 delay 的链路
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithTLSConfig(&tls.Config{RootCAs: pool}),
+		tunnel.WithTLSVerify(slow),
+		tunnel.WithHappyEyeballs(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	if addr := tun.BrkAddr(); !addr.TLS {
+		t.Fatalf("竞速连接降级为明文：%s", addr)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(brk.Certificate())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithTLSOnly(),
+		tunnel.WithTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS13}),
+		tunnel.WithTLSPins(tunnel.PinSHA256(brk.Certificate())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	if addr := tun.BrkAddr(); !addr.TLS {
+		t.Fatalf("没有使用 TLS 连接：%s", addr)
+	}
+}
+
+func TestDialTLSPinMismatch(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(brk.Certificate())
+	_, other := newCertificate()
+	err := dialPinned(t, brk.Hide(), &tls.Config{RootCAs: pool}, tunnel.PinSHA256(other))
+	if !errors.Is(err, tunnel.ErrPinMismatch) {
+		t.Fatalf("期望 ErrPinMismatch，实际：%v", err)
+	}
+}
+
+func TestDialTLSPinAppended(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	// 攻击者使用自己的证书，并在证书链后附加真实 broker 的证书。
+	fake, _ := newCertificate()
+	fake.Certificate = append(fake.Certificate, brk.Certificate().Raw)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{fake}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, exx := ln.Accept()
+			if exx != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	hide := brk.Hide()
+	hide.Addrs = []string{ln.Addr().String()}
+	err = dialPinned(t, hide, &tls.Config{InsecureSkipVerify: true}, tunnel.PinSHA256(brk.Certificate()))
+	if !errors.Is(err, tunnel.ErrPinMismatch) {
+		t.Fatalf("附加了固定证书的证书链应被拒绝，实际：%v", err)
+	}
+}
+
+// dialPinned 使用公钥指纹连接 broker，返回 Selector 收到的第一个连接错误。
+func dialPinned(t *testing.T, hide definition.MHide, cfg *tls.Config, pin string) error {
+	t.Helper()
+	sel := &reportSelector{Selector: tunnel.NewRoundRobinSelector()}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, hide, nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithTLSOnly(),
+		tunnel.WithSelector(sel),
+		tunnel.WithTLSConfig(cfg),
+		tunnel.WithTLSPins(pin))
+	if err == nil {
+		_ = tun.Close()
+		t.Fatal("指纹不匹配时不应该连接成功")
+	}
+
+	sel.mutex.Lock()
+	defer sel.mutex.Unlock()
+	if len(sel.errs) == 0 {
+		return err
+	}
+	return sel.errs[0]
+}
+
+func TestDialProxy(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	// 简易 HTTP CONNECT 代理。
+	var tunnels atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		src, _, _ := w.(http.Hijacker).Hijack()
+		_, _ = src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		tunnels.Add(1)
+		go func() { _, _ = io.Copy(dst, src); _ = dst.Close() }()
+		_, _ = io.Copy(src, dst)
+		_ = src.Close()
+	}))
+	defer proxy.Close()
+
+	pu, _ := url.Parse(proxy.URL)
+	pu.User = url.UserPassword("agent", "secret")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithProxy(tunnel.ProxyURL(pu)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	addr := tun.BrkAddr()
+	if tunnels.Load() == 0 || addr.Proxy == "" || strings.Contains(addr.String(), "secret") {
+		t.Fatalf("没有经过代理或者泄露了代理密码：%s", addr)
+	}
+}
+
+func TestDialNotAcceptable(t *testing.T) {
+	brk := NewUnstartedBroker(nil)
+	brk.Handshake = func(tunnel.Ident) (tunnel.Issue, error) {
+		return tunnel.Issue{}, Reject(http.StatusNotAcceptable, "deleted")
+	}
+	brk.Start()
+	defer brk.Close()
+
+	_, err := tunnel.Dial(context.Background(), brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	var he *netutil.HTTPError
+	if !errors.As(err, &he) || !he.NotAcceptable() {
+		t.Fatalf("期望 406 不可重试错误，实际：%v", err)
+	}
+	if n := brk.Attempts(); n != 1 {
+		t.Fatalf("不可重试的错误不应该重试，实际握手 %d 次", n)
+	}
+}
+
+// reportSelector 记录 Report 反馈的错误。
+type reportSelector struct {
+	tunnel.Selector
+	mutex sync.Mutex
+	errs  []error
+}
+
+func (rs *reportSelector) Report(addr *tunnel.Address, rtt time.Duration, err error) {
+	rs.mutex.Lock()
+	if err != nil {
+		rs.errs = append(rs.errs, err)
+	}
+	rs.mutex.Unlock()
+	rs.Selector.Report(addr, rtt, err)
+}
+
+func TestDialReportHandshake(t *testing.T) {
+	brk := NewUnstartedBroker(nil)
+	brk.Handshake = func(tunnel.Ident) (tunnel.Issue, error) {
+		if brk.Attempts() == 1 {
+			return tunnel.Issue{}, Reject(http.StatusInternalServerError, "busy")
+		}
+		return tunnel.Issue{ID: 1, Passwd: []byte("passwd")}, nil
+	}
+	brk.Start()
+	defer brk.Close()
+
+	sel := &reportSelector{Selector: tunnel.NewRoundRobinSelector()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}), tunnel.WithSelector(sel))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	sel.mutex.Lock()
+	defer sel.mutex.Unlock()
+	var reported bool
+	for _, exx := range sel.errs {
+		var he *netutil.HTTPError
+		reported = reported || errors.As(exx, &he) && he.Code == http.StatusInternalServerError
+	}
+	if !reported {
+		t.Fatalf("握手失败应反馈给 Selector：%v", sel.errs)
+	}
+}
+
+// 粘滞地址在握手成功后才会持久化，TCP/TLS 连接成功但握手失败的地址不能记录。
+func TestDialStickyHandshake(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sticky.json")
+	var early atomic.Bool
+	brk := NewUnstartedBroker(nil)
+	brk.Handshake = func(tunnel.Ident) (tunnel.Issue, error) {
+		if _, err := os.Stat(file); err == nil {
+			early.Store(true)
+		}
+		if brk.Attempts() == 1 {
+			return tunnel.Issue{}, Reject(http.StatusInternalServerError, "busy")
+		}
+		return tunnel.Issue{ID: 1, Passwd: []byte("passwd")}, nil
+	}
+	brk.Start()
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}), tunnel.WithSelector(tunnel.NewStickySelector(file, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	if early.Load() {
+		t.Fatal("握手成功前不应记录粘滞地址")
+	}
+	if _, err = os.Stat(file); err != nil {
+		t.Fatalf("握手成功后应记录粘滞地址：%v", err)
+	}
+}
+
+func TestDialConflict(t *testing.T) {
+	brk := NewUnstartedBroker(nil)
+	brk.Handshake = func(ident tunnel.Ident) (tunnel.Issue, error) {
+		if ident.MachineID == "tunneltest" {
+			return tunnel.Issue{}, Reject(http.StatusConflict, "duplicate")
+		}
+		return tunnel.Issue{ID: 1, Passwd: []byte("passwd")}, nil
+	}
+	brk.Start()
+	defer brk.Close()
+
+	mid := new(machineID)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(mid), tunnel.WithBackoff(fastBackoff{})); err != nil {
+		t.Fatal(err)
+	}
+	if n := mid.rebuilds.Load(); n != 1 {
+		t.Fatalf("期望重新生成 1 次机器码，实际 %d 次", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := tun.State(); st != tunnel.StateConnected {
+		t.Fatalf("期望 %s，实际 %s", tunnel.StateConnected, st)
+	}
+
+	events := tun.Subscribe(ctx)
+	<-events
+	brk.CloseSessions()
+
+	var seen []tunnel.State
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case evt := <-events:
+			seen = append(seen, evt.To)
+			if evt.To != tunnel.StateConnected {
+				continue
+			}
+			if seen[0] != tunnel.StateDisconnected {
+				t.Fatalf("状态变更顺序不正确：%v", seen)
+			}
+			if n := brk.Handled(); n != 2 {
+				t.Fatalf("期望握手成功 2 次，实际 %d 次", n)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("等待重连超时：%v", seen)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	ln := tun.Listener()
+	metas := make(chan tunnel.StreamMeta, 2)
+	go func() {
+		for {
+			conn, exx := ln.Accept()
+			if exx != nil {
+				close(metas)
+				return
+			}
+			metas <- conn.(*tunnel.BrokerConn).Meta()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	// 断开重连前后，同一个监听器都可以接收 broker 发起的流。
+	for want := uint64(1); want <= 2; want++ {
+		var sess *Session
+		select {
+		case sess = <-brk.Sessions:
+		case <-time.After(10 * time.Second):
+			t.Fatal("等待会话超时")
+		}
+		conn, exx := sess.OpenStream()
+		if exx != nil {
+			t.Fatal(exx)
+		}
+		_, _ = conn.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, exx = io.ReadFull(conn, buf); exx != nil || string(buf) != "ping" {
+			t.Fatalf("流读写错误：%q %v", buf, exx)
+		}
+		_ = conn.Close()
+
+		if meta := <-metas; meta.Session != want || meta.Broker == nil {
+			t.Fatalf("流元数据不正确：%+v", meta)
+		}
+		brk.CloseSessions()
+	}
+
+	_ = tun.Close()
+	if _, ok := <-metas; ok {
+		t.Fatal("通道关闭后监听器应当返回错误")
+	}
+}
+
+type countNotifier struct {
+	connected atomic.Int32
+	shutdown  atomic.Int32
+}
+
+func (n *countNotifier) Connected(*tunnel.Address) { n.connected.Add(1) }
+func (*countNotifier) Disconnect(error)            {}
+func (*countNotifier) Reconnected(*tunnel.Address) {}
+func (n *countNotifier) Shutdown(error)            { n.shutdown.Add(1) }
+
+func TestShutdown(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	started := make(chan struct{})
+	agent := http.NewServeMux()
+	agent.HandleFunc("/slow", func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	ntf := new(countNotifier)
+	tun, err := tunnel.Dial(context.Background(), brk.Hide(), &http.Server{Handler: agent},
+		tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}), tunnel.WithNotifier(ntf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := <-brk.Sessions
+
+	type result struct {
+		body string
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		res, exx := sess.Client().Get("http://agent/slow")
+		if exx != nil {
+			resc <- result{err: exx}
+			return
+		}
+		body, exx := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		resc <- result{body: string(body), err: exx}
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = tun.Shutdown(ctx); err != nil {
+		t.Fatalf("优雅关闭失败：%v", err)
+	}
+	if res := <-resc; res.err != nil || res.body != "done" {
+		t.Fatalf("关闭时未完成的请求应正常完成：%q %v", res.body, res.err)
+	}
+
+	_ = tun.Close()
+	if n := ntf.shutdown.Load(); n != 1 {
+		t.Fatalf("Notifier.Shutdown 应只通知 1 次，实际 %d 次", n)
+	}
+	if st := tun.State(); st != tunnel.StateShutdown {
+		t.Fatalf("期望 %s，实际 %s", tunnel.StateShutdown, st)
+	}
+	select {
+	case <-sess.Done():
+	case <-time.After(time.Second):
+		t.Fatal("关闭后会话应断开")
+	}
+}
+
+// closeNotifier 在指定的回调中关闭通道。
+type closeNotifier struct {
+	on     string
+	ready  chan struct{} // Dial 返回后关闭，Connected 回调早于 Dial 返回
+	tun    tunnel.Tunneler
+	closed chan error
+}
+
+func (n *closeNotifier) Connected(*tunnel.Address)   { n.close("Connected") }
+func (n *closeNotifier) Disconnect(error)            { n.close("Disconnect") }
+func (n *closeNotifier) Reconnected(*tunnel.Address) { n.close("Reconnected") }
+func (n *closeNotifier) Shutdown(error)              { n.close("Shutdown") }
+
+func (n *closeNotifier) close(on string) {
+	if on != n.on {
+		return
+	}
+	<-n.ready
+	n.closed <- n.tun.Close()
+}
+
+func TestCloseInNotifier(t *testing.T) {
+	for _, on := range []string{"Connected", "Disconnect", "Reconnected", "Shutdown"} {
+		t.Run(on, func(t *testing.T) {
+			t.Parallel()
+
+			var handshakes atomic.Int32
+			brk := NewUnstartedBroker(nil)
+			brk.Handshake = func(tunnel.Ident) (tunnel.Issue, error) {
+				if handshakes.Add(1) > 1 && on == "Shutdown" { // 重连时遇到不可重试的错误
+					return tunnel.Issue{}, Reject(http.StatusNotAcceptable, "deleted")
+				}
+				return tunnel.Issue{ID: 1}, nil
+			}
+			brk.Start()
+			defer brk.Close()
+
+			ntf := &closeNotifier{on: on, ready: make(chan struct{}), closed: make(chan error, 1)}
+			tun, err := tunnel.Dial(context.Background(), brk.Hide(), nil,
+				tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}), tunnel.WithNotifier(ntf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ntf.tun = tun
+			close(ntf.ready)
+			if on != "Connected" {
+				brk.CloseSessions()
+			}
+
+			select {
+			case <-ntf.closed:
+			case <-time.After(15 * time.Second):
+				t.Fatalf("在 %s 回调中调用 Close 死锁", on)
+			}
+			if st := tun.State(); st != tunnel.StateShutdown {
+				t.Fatalf("期望 %s，实际 %s", tunnel.StateShutdown, st)
+			}
+			_ = tun.Close()
+		})
+	}
+}
+
+// errNotifier 记录 Notifier.Shutdown 的原因。
+type errNotifier struct {
+	countNotifier
+	errs chan error
+}
+
+func (n *errNotifier) Shutdown(err error) {
+	n.countNotifier.Shutdown(err)
+	n.errs <- err
+}
+
+func TestCancelParent(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	ntf := &errNotifier{errs: make(chan error, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}), tunnel.WithNotifier(ntf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	select {
+	case err = <-ntf.errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("取消 parent 时期望通知 context.Canceled，实际：%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("取消 parent 后未通知 Notifier.Shutdown")
+	}
+	if st := tun.State(); st != tunnel.StateShutdown {
+		t.Fatalf("期望 %s，实际 %s", tunnel.StateShutdown, st)
+	}
+}
+
+func TestDialFailedNoShutdown(t *testing.T) {
+	brk := NewUnstartedBroker(nil)
+	brk.Handshake = func(tunnel.Ident) (tunnel.Issue, error) {
+		return tunnel.Issue{}, Reject(http.StatusNotAcceptable, "deleted")
+	}
+	brk.Start()
+	defer brk.Close()
+
+	ntf := &errNotifier{errs: make(chan error, 1)}
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}), tunnel.WithNotifier(ntf)); err == nil {
+		t.Fatal("期望连接失败")
+	}
+	cancel()
+
+	select {
+	case err := <-ntf.errs:
+		t.Fatalf("Dial 失败的通道不应该通知 Notifier.Shutdown：%v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestDialAsync(t *testing.T) {
+	var attempts atomic.Int32
+	brk := NewUnstartedBroker(nil)
+	brk.Handshake = func(tunnel.Ident) (tunnel.Issue, error) {
+		if attempts.Add(1) < 3 {
+			return tunnel.Issue{}, Reject(http.StatusServiceUnavailable, "busy")
+		}
+		return tunnel.Issue{ID: 1}, nil
+	}
+	brk.Start()
+	defer brk.Close()
+
+	ntf := new(countNotifier)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.DialAsync(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}), tunnel.WithNotifier(ntf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 首次连接成功前 DialContext 会一直等待
+	reqCtx, reqCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer reqCancel()
+	if err = tun.Oneway(reqCtx, "/api/v1/minion/ping", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if st := tun.State(); st != tunnel.StateConnected {
+		t.Fatalf("期望 %s，实际 %s", tunnel.StateConnected, st)
+	}
+	for deadline := time.Now().Add(time.Second); ntf.connected.Load() == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := ntf.connected.Load(); n != 1 {
+		t.Fatalf("Notifier.Connected 应通知 1 次，实际 %d 次", n)
+	}
+	_ = tun.Close()
+}
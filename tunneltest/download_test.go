@@ -0,0 +1,246 @@
+package tunneltest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestDownloadFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // 1MiB
+	sum := md5.Sum(content)
+	hash := hex.EncodeToString(sum[:])
+
+	var brk *Broker
+	var calls atomic.Int32
+	var resumed atomic.Value
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/upgrade/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="ssoc"; hash="`+hash+`"`)
+		if calls.Add(1) == 1 { // 第一次下载到一半断开会话
+			w.Header().Set("Content-Length", "1048576")
+			_, _ = w.Write(content[:300*1024])
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			brk.CloseSessions()
+			return
+		}
+		resumed.Store(r.Header.Get("Range"))
+		http.ServeContent(w, r, "ssoc", time.Time{}, bytes.NewReader(content))
+	})
+	h.HandleFunc("/api/v1/broker/third", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="ip2region.db"; hash="0000"`)
+		_, _ = w.Write(content[:10])
+	})
+	brk = NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "ssoc")
+	var last, total int64
+	err = tun.DownloadFile(ctx, "/api/v1/broker/upgrade/download", dest, func(written, size int64) {
+		last, total = written, size
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Fatalf("下载的文件内容错误，长度 %d", len(got))
+	}
+	if rng, _ := resumed.Load().(string); rng == "" || rng == "bytes=0-" {
+		t.Fatalf("断线后应该续传，实际 Range：%q", rng)
+	}
+	if calls.Load() != 2 || last != int64(len(content)) || total != int64(len(content)) {
+		t.Fatalf("续传错误：请求 %d 次，进度 %d/%d", calls.Load(), last, total)
+	}
+	if _, err = os.Stat(dest + ".download"); !os.IsNotExist(err) {
+		t.Fatalf("临时文件应被重命名：%v", err)
+	}
+	if _, err = os.Stat(dest + ".download.meta"); !os.IsNotExist(err) {
+		t.Fatalf("下载完毕后应删除版本记录：%v", err)
+	}
+
+	// 校验失败
+	third := filepath.Join(dir, "ip2region.db")
+	if err = tun.DownloadFile(ctx, "/api/v1/broker/third", third, nil); !errors.Is(err, tunnel.ErrChecksum) {
+		t.Fatalf("期望 ErrChecksum，实际：%v", err)
+	}
+	if _, err = os.Stat(third); !os.IsNotExist(err) {
+		t.Fatal("校验失败时不应生成目标文件")
+	}
+	if _, err = os.Stat(third + ".download"); !os.IsNotExist(err) {
+		t.Fatal("校验失败时应删除临时文件")
+	}
+}
+
+func TestDownloadFileChanged(t *testing.T) {
+	v1 := bytes.Repeat([]byte("v1"), 256*1024)
+	v2 := bytes.Repeat([]byte("v2"), 256*1024)
+	disposition := func(content []byte) string {
+		sum := md5.Sum(content)
+		return `attachment; filename="ssoc"; hash="` + hex.EncodeToString(sum[:]) + `"`
+	}
+
+	var brk *Broker
+	var calls atomic.Int32
+	var ifRange atomic.Value
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/upgrade/download", func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1: // 下载 v1 到一半断开会话
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Disposition", disposition(v1))
+			w.Header().Set("Content-Length", "524288")
+			_, _ = w.Write(v1[:100*1024])
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			brk.CloseSessions()
+		case 2: // 远端已经更新为 v2，并且忽略了 If-Range
+			ifRange.Store(r.Header.Get("If-Range"))
+			w.Header().Set("ETag", `"v2"`)
+			w.Header().Set("Content-Disposition", disposition(v2))
+			r.Header.Del("If-Range")
+			http.ServeContent(w, r, "ssoc", time.Time{}, bytes.NewReader(v2))
+		default:
+			w.Header().Set("ETag", `"v2"`)
+			w.Header().Set("Content-Disposition", disposition(v2))
+			http.ServeContent(w, r, "ssoc", time.Time{}, bytes.NewReader(v2))
+		}
+	})
+	brk = NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	dest := filepath.Join(t.TempDir(), "ssoc")
+	if err = tun.DownloadFile(ctx, "/api/v1/broker/upgrade/download", dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ifRange.Load().(string); got != `"v1"` {
+		t.Fatalf("续传时应携带 If-Range，实际：%q", got)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, v2) {
+		t.Fatalf("远端文件变化后应重新下载，实际长度 %d", len(got))
+	}
+	if n := calls.Load(); n != 3 {
+		t.Fatalf("期望请求 3 次，实际 %d 次", n)
+	}
+}
+
+func TestDownloadFileLeftover(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 16*1024)
+	var ranges, ifRanges []string
+	var mutex sync.Mutex
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/upgrade/download", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		ifRanges = append(ifRanges, r.Header.Get("If-Range"))
+		mutex.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "ssoc", time.Time{}, bytes.NewReader(content))
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	dir := t.TempDir()
+
+	// 没有版本记录的临时文件无法判断远端文件是否变化，应从头下载
+	dest := filepath.Join(dir, "nometa")
+	if err = os.WriteFile(dest+".download", []byte("stale content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = tun.DownloadFile(ctx, "/api/v1/broker/upgrade/download", dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Fatalf("下载的文件内容错误，长度 %d", len(got))
+	}
+
+	// 有版本记录的临时文件应携带 If-Range 续传
+	dest = filepath.Join(dir, "meta")
+	if err = os.WriteFile(dest+".download", content[:1000], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(dest+".download.meta", []byte(`{"validator":"\"v1\""}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = tun.DownloadFile(ctx, "/api/v1/broker/upgrade/download", dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, content) {
+		t.Fatalf("续传的文件内容错误，长度 %d", len(got))
+	}
+	if _, err = os.Stat(dest + ".download.meta"); !os.IsNotExist(err) {
+		t.Fatalf("下载完毕后应删除版本记录：%v", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(ranges) != 2 || ranges[0] != "" || ranges[1] != "bytes=1000-" || ifRanges[1] != `"v1"` {
+		t.Fatalf("请求错误，Range：%q，If-Range：%q", ranges, ifRanges)
+	}
+}
+
+func TestDownloadFileHTTPError(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/upgrade/download", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	dest := filepath.Join(t.TempDir(), "ssoc")
+	err = tun.DownloadFile(ctx, "/api/v1/broker/upgrade/download", dest, nil, tunnel.RequireChecksum())
+	var he *netutil.HTTPError
+	if !errors.As(err, &he) || he.Code != http.StatusNotModified {
+		t.Fatalf("期望 304，实际：%v", err)
+	}
+	for _, name := range []string{dest, dest + ".download", dest + ".download.meta"} {
+		if _, err = os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("%s 应被删除：%v", name, err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package tunneltest
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestFileCache(t *testing.T) {
+	files := map[string][]byte{
+		"a.db": bytes.Repeat([]byte("a"), 1000),
+		"b.db": bytes.Repeat([]byte("b"), 1000),
+	}
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/third", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		data, ok := files[q.Get("name")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		sum := md5.Sum(data)
+		hash := hex.EncodeToString(sum[:])
+		if q.Get("hash") == hash {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="`+q.Get("name")+`"; hash="`+hash+`"`)
+		_, _ = w.Write(data)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	dir := t.TempDir()
+	cache, err := tunnel.OpenFileCache(tun, dir, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := cache.Third(ctx, "a.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Modified || f.Size != 1000 {
+		t.Fatalf("首次下载错误：%+v", f)
+	}
+	if f, err = cache.Third(ctx, "a.db"); err != nil || f.Modified {
+		t.Fatalf("期望命中缓存（304）：%+v %v", f, err)
+	}
+
+	// 超过容量时淘汰最久未使用的 a.db
+	if _, err = cache.Third(ctx, "b.db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Lookup("a.db"); ok {
+		t.Fatal("a.db 应被淘汰")
+	}
+	data, err := fs.ReadFile(cache.FS(), "b.db")
+	if err != nil || !bytes.Equal(data, files["b.db"]) {
+		t.Fatalf("读取缓存文件错误：%v", err)
+	}
+	ents, err := fs.ReadDir(cache.FS(), ".")
+	if err != nil || len(ents) != 1 || ents[0].Name() != "b.db" {
+		t.Fatalf("目录列表错误：%v %v", ents, err)
+	}
+
+	// 重新打开时删除损坏的文件
+	f, _ = cache.Lookup("b.db")
+	if err = os.WriteFile(f.Path, []byte("corrupted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = tunnel.OpenFileCache(tun, dir, 1500); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Lookup("b.db"); ok {
+		t.Fatal("损坏的文件应被删除")
+	}
+	if _, err = os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Fatalf("损坏的文件应被删除：%v", err)
+	}
+}
+
+func TestFileCacheInvalidName(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := tunnel.OpenFileCache(nil, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", ".", "..", "../x", `..\..\x`, `a\b`, "a/b"} {
+		if _, err = cache.Get(context.Background(), name, "/api/v1/broker/third"); !errors.Is(err, fs.ErrInvalid) {
+			t.Fatalf("文件名 %q 应被拒绝，实际：%v", name, err)
+		}
+	}
+
+	// 索引中的非法文件名不会被加载。
+	data := []byte("evil")
+	sum := md5.Sum(data)
+	hash := hex.EncodeToString(sum[:])
+	if err = os.WriteFile(filepath.Join(dir, "objects", hash), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	index := `[{"name":"..\\evil","hash":"` + hash + `","size":4}]`
+	if err = os.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if cache, err = tunnel.OpenFileCache(nil, dir, 0); err != nil {
+		t.Fatal(err)
+	}
+	if files := cache.Files(); len(files) != 0 {
+		t.Fatalf("索引中的非法文件名应被忽略：%+v", files)
+	}
+}
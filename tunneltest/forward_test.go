@@ -0,0 +1,315 @@
+package tunneltest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+// relayHandler 模拟 broker 的 /api/v1/broker/stream/tunnel 接口。
+func relayHandler(w http.ResponseWriter, r *http.Request) {
+	network, addr, _ := strings.Cut(r.URL.Query().Get("address"), "://")
+	dst, err := net.Dial(network, addr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer dst.Close()
+
+	upgrade := websocket.Upgrader{}
+	ws, err := upgrade.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, exx := dst.Read(buf)
+			if exx != nil {
+				_ = ws.Close()
+				return
+			}
+			if exx = ws.WriteMessage(websocket.BinaryMessage, buf[:n]); exx != nil {
+				return
+			}
+		}
+	}()
+	for {
+		_, data, exx := ws.ReadMessage()
+		if exx != nil {
+			return
+		}
+		if _, exx = dst.Write(data); exx != nil {
+			return
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/stream/tunnel", relayHandler)
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	// 远端 TCP 与 UDP 回显服务。
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, exx := echo.Accept()
+			if exx != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); _ = conn.Close() }()
+		}
+	}()
+	uecho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uecho.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, exx := uecho.ReadFrom(buf)
+			if exx != nil {
+				return
+			}
+			_, _ = uecho.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	local, ulocal := freeAddr(t, "tcp"), freeAddr(t, "udp")
+	fwd := tunnel.NewForwarder(tun,
+		tunnel.ForwardSpec{Network: "tcp", Local: local, Remote: echo.Addr().String()},
+		tunnel.ForwardSpec{Network: "udp", Local: ulocal, Remote: uecho.LocalAddr().String()})
+	closed := make(chan *tunnel.ForwardConn, 2)
+	fwd.OnClose = func(fc *tunnel.ForwardConn, _ error) { closed <- fc }
+	go func() { _ = fwd.Run(ctx) }()
+
+	var conn net.Conn
+	for i := 0; i < 50; i++ { // 等待本地监听
+		if conn, err = net.Dial("tcp", local); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("TCP 转发错误：%q %v", buf, err)
+	}
+	_ = conn.Close()
+	select {
+	case fc := <-closed:
+		if fc.Sent() != 5 || fc.Received() != 5 {
+			t.Fatalf("流量统计错误：%d %d", fc.Sent(), fc.Received())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待连接结束超时")
+	}
+
+	uconn, err := net.Dial("udp", ulocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	_ = uconn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _ = uconn.Write([]byte("ping"))
+	if n, exx := uconn.Read(buf); exx != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("UDP 转发错误：%q %v", buf[:n], exx)
+	}
+}
+
+func TestForwardUDPSlowRelay(t *testing.T) {
+	var relays atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/stream/tunnel", func(w http.ResponseWriter, r *http.Request) {
+		if relays.Add(1) == 1 { // 第一个会话的流建立很慢
+			time.Sleep(2 * time.Second)
+		}
+		relayHandler(w, r)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	uecho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uecho.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, exx := uecho.ReadFrom(buf)
+			if exx != nil {
+				return
+			}
+			_, _ = uecho.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	ulocal := freeAddr(t, "udp")
+	fwd := tunnel.NewForwarder(tun, tunnel.ForwardSpec{Network: "udp", Local: ulocal, Remote: uecho.LocalAddr().String()})
+	go func() { _ = fwd.Run(ctx) }()
+
+	slow, err := net.Dial("udp", ulocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	// 本地开始监听前发出的数据报会被丢弃，重发直到转发器开始建立流。
+	for i := 0; relays.Load() == 0; i++ {
+		if i == 250 {
+			t.Fatal("等待本地监听超时")
+		}
+		_, _ = slow.Write([]byte("slow"))
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// 慢会话建立期间，其它客户端的转发不受影响。
+	fast, err := net.Dial("udp", ulocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	buf := make([]byte, 16)
+	start := time.Now()
+	_ = fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _ = fast.Write([]byte("fast"))
+	if n, exx := fast.Read(buf); exx != nil || string(buf[:n]) != "fast" {
+		t.Fatalf("UDP 转发错误：%q %v", buf[:n], exx)
+	}
+	if du := time.Since(start); du > time.Second {
+		t.Fatalf("慢会话阻塞了其它客户端：%s", du)
+	}
+
+	// 流建立期间缓存的数据报在建立后发出。
+	_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, exx := slow.Read(buf); exx != nil || string(buf[:n]) != "slow" {
+		t.Fatalf("缓存的数据报转发错误：%q %v", buf[:n], exx)
+	}
+}
+
+func TestForwardRelisten(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	local := freeAddr(t, "tcp")
+	fwd := tunnel.NewForwarder(tun, tunnel.ForwardSpec{Local: local, Remote: "127.0.0.1:1"})
+	failures := make(chan error, 8)
+	fwd.OnListenError = func(_ tunnel.ForwardSpec, err error) { failures <- err }
+	errc := make(chan error, 1)
+	go func() { errc <- fwd.Run(ctx) }()
+	for i := 0; i < 50; i++ { // 等待本地监听
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", local); err == nil {
+			_ = conn.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 断线期间本地端口被占用，重连后重新监听失败。
+	events := tun.Subscribe(ctx)
+	brk.CloseSessions()
+	for evt := range events {
+		if evt.To == tunnel.StateDisconnected {
+			break
+		}
+	}
+	var occupy net.Listener
+	for i := 0; i < 50; i++ {
+		if occupy, err = net.Listen("tcp", local); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-failures:
+	case exx := <-errc:
+		t.Fatalf("重新监听失败后不应退出：%v", exx)
+	case <-time.After(15 * time.Second):
+		t.Fatal("等待重新监听失败超时")
+	}
+
+	// 端口释放后重试成功。
+	_ = occupy.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if conn, exx := net.Dial("tcp", local); exx == nil {
+			_ = conn.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("端口释放后没有重新监听")
+}
+
+// freeAddr 获取一个空闲的本地地址。
+func freeAddr(t *testing.T, network string) string {
+	var addr string
+	if network == "udp" {
+		pc, err := net.ListenPacket(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = pc.LocalAddr().String()
+		_ = pc.Close()
+	} else {
+		ln, err := net.Listen(network, "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = ln.Addr().String()
+		_ = ln.Close()
+	}
+
+	return addr
+}
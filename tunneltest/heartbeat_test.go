@@ -0,0 +1,138 @@
+package tunneltest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var pings atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("POST /api/v1/minion/ping", func(w http.ResponseWriter, r *http.Request) {
+		if pings.Add(1) == 1 { // 第一次心跳失败
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{"interval": 300000000000}`)) // broker 下发 5min 间隔
+	})
+	var reported atomic.Int64 // 握手时上报的心跳间隔
+	brk := NewUnstartedBroker(h)
+	brk.Handshake = func(ident tunnel.Ident) (tunnel.Issue, error) {
+		reported.Store(int64(ident.Interval))
+		return tunnel.Issue{ID: 1, Passwd: []byte("passwd")}, nil
+	}
+	brk.Start()
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithInterval(time.Minute),
+		tunnel.WithHeartbeatProbe(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	hb := tun.Heartbeat()
+	if stats := hb.Stats(); stats.Interval != time.Minute || stats.Sent != 0 {
+		t.Fatalf("初始统计错误：%+v", stats)
+	}
+
+	// 第一次心跳失败后快速探测，不必等待完整的心跳间隔。
+	hb.Probe()
+	deadline := time.Now().Add(5 * time.Second)
+	for hb.Stats().Sent < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := hb.Stats()
+	if stats.Sent != 2 || stats.Lost != 1 || stats.Failures != 0 || stats.LossRate != 0.5 {
+		t.Fatalf("心跳统计错误：%+v", stats)
+	}
+	if stats.LastRTT <= 0 || stats.P50 != stats.LastRTT || stats.P99 != stats.LastRTT || stats.LastSuccess.IsZero() {
+		t.Fatalf("RTT 统计错误：%+v", stats)
+	}
+	if stats.Interval != 2*time.Minute {
+		t.Fatalf("broker 下发的心跳间隔应限制在握手间隔的 2 倍以内：%s", stats.Interval)
+	}
+
+	hb.SetInterval(time.Second)
+	if du := hb.Interval(); du != time.Minute {
+		t.Fatalf("心跳间隔应限制在 1min - 20min 之间：%s", du)
+	}
+	hb.SetInterval(90 * time.Second)
+	if du := hb.Interval(); du != 90*time.Second {
+		t.Fatalf("未超过握手间隔 2 倍的心跳间隔应立即生效：%s", du)
+	}
+	hb.SetInterval(20 * time.Minute)
+	if du := hb.Interval(); du != 2*time.Minute {
+		t.Fatalf("重连前心跳间隔不应超过握手间隔的 2 倍：%s", du)
+	}
+
+	// 重连握手时上报新的间隔，之后完全生效。
+	events := tun.Subscribe(ctx)
+	brk.CloseSessions()
+	var disconnected bool
+	for evt := range events {
+		disconnected = disconnected || evt.To == tunnel.StateDisconnected
+		if disconnected && evt.To == tunnel.StateConnected {
+			break
+		}
+	}
+	if du := time.Duration(reported.Load()); du != 20*time.Minute {
+		t.Fatalf("重连时应上报新的心跳间隔：%s", du)
+	}
+	if du := hb.Interval(); du != 20*time.Minute {
+		t.Fatalf("重连后心跳间隔应完全生效：%s", du)
+	}
+	hb.SetInterval(0)
+	if du := hb.Stats().Interval; du != 0 {
+		t.Fatalf("心跳应暂停：%s", du)
+	}
+}
+
+func TestHeartbeatPayload(t *testing.T) {
+	snaps := make(chan tunnel.HealthSnapshot, 1)
+	h := http.NewServeMux()
+	h.HandleFunc("POST /api/v1/minion/ping", func(w http.ResponseWriter, r *http.Request) {
+		var snap tunnel.HealthSnapshot
+		if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		snaps <- snap
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithHeartbeatPayload(func(_ context.Context, snap tunnel.HealthSnapshot) any {
+			snap.Checks = map[string]string{"db": "ok"}
+			return snap
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	tun.Heartbeat().Probe()
+	select {
+	case snap := <-snaps:
+		if snap.Goroutines <= 0 || snap.HeapAlloc == 0 || snap.Checks["db"] != "ok" {
+			t.Fatalf("心跳报文错误：%+v", snap)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("未收到心跳")
+	}
+}
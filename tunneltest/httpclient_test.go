@@ -0,0 +1,78 @@
+package tunneltest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestHTTPClient(t *testing.T) {
+	var calls atomic.Int32
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/echo", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	})
+	var brk *Broker
+	h.HandleFunc("/api/v1/broker/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 { // 第一次请求时断开会话
+			brk.CloseSessions()
+			<-r.Context().Done()
+			return
+		}
+		_, _ = io.WriteString(w, "ok")
+	})
+	brk = NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	cli := tun.HTTPClient()
+	if cli != tun.HTTPClient() {
+		t.Fatal("HTTPClient 每次应返回同一个客户端")
+	}
+	res, err := cli.Post("http://soc/api/v1/broker/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "hello" {
+		t.Fatalf("响应错误：%q", body)
+	}
+
+	// 请求过程中会话断开，GET 请求在新会话上重试。
+	res, err = cli.Get("http://soc/api/v1/broker/flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "ok" || calls.Load() != 2 {
+		t.Fatalf("重试错误：%q，调用 %d 次", body, calls.Load())
+	}
+	if brk.Handled() != 2 {
+		t.Fatalf("期望重连 1 次，实际握手成功 %d 次", brk.Handled())
+	}
+
+	// 非幂等请求不重试。
+	calls.Store(0)
+	if _, err = cli.Post("http://soc/api/v1/broker/flaky", "text/plain", nil); err == nil {
+		t.Fatal("POST 请求不应该重试")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("POST 请求调用了 %d 次", calls.Load())
+	}
+}
@@ -0,0 +1,110 @@
+package tunneltest
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestHTTPProxy(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/stream/tunnel", relayHandler)
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer origin.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	px := tunnel.NewHTTPProxy(tun)
+	px.Username, px.Password = "ops", "secret"
+	px.Allow = []string{"127.0.0.1"}
+	go func() { _ = px.Serve(ln) }()
+	defer px.Close()
+
+	proxyURL := &url.URL{Scheme: "http", User: url.UserPassword("ops", "secret"), Host: ln.Addr().String()}
+	cli := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	// 普通请求
+	res, err := cli.Get(origin.URL + "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hello /plain" {
+		t.Fatalf("代理请求错误：%d %q", res.StatusCode, body)
+	}
+
+	// 不在允许列表中
+	res, err = cli.Get("http://localhost:1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Fatalf("期望 403，实际：%d", res.StatusCode)
+	}
+
+	// 认证失败
+	proxyURL.User = url.UserPassword("ops", "wrong")
+	res, err = cli.Get(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("期望 407，实际：%d", res.StatusCode)
+	}
+
+	// CONNECT 隧道
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dest := origin.Listener.Addr().String()
+	req, _ := http.NewRequest(http.MethodConnect, "http://"+dest, nil)
+	req.Host = dest
+	req.SetBasicAuth("ops", "secret")
+	req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+	if err = req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	rd := bufio.NewReader(conn)
+	if res, err = http.ReadResponse(rd, req); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT 失败：%v %v", res, err)
+	}
+	get, _ := http.NewRequest(http.MethodGet, origin.URL+"/tunnel", nil)
+	if err = get.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = http.ReadResponse(rd, get); err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	_ = res.Body.Close()
+	if string(body) != "hello /tunnel" {
+		t.Fatalf("CONNECT 隧道响应错误：%q", body)
+	}
+}
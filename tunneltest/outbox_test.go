@@ -0,0 +1,191 @@
+package tunneltest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestOutbox(t *testing.T) {
+	reports := make(chan string, 8)
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reports <- r.URL.Path + " " + string(body)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithOutbox(tunnel.OutboxConfig{
+			Dir: t.TempDir(),
+			Policies: map[string]tunnel.OutboxPolicy{
+				"/api/v1/broker/audit/event":           {Priority: 1},
+				"/api/v1/broker/collect/agent/process": {Dedupe: true},
+			},
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	// 在线时直接发送
+	if err = tun.OnewayJSON(ctx, "/api/v1/broker/collect/agent/process", 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-reports; got != "/api/v1/broker/collect/agent/process 0\n" {
+		t.Fatalf("上报错误：%q", got)
+	}
+
+	events := tun.Subscribe(ctx)
+	brk.CloseSessions()
+	for evt := range events {
+		if evt.To == tunnel.StateDisconnected {
+			break
+		}
+	}
+
+	// 离线时入队
+	for i, path := range []string{
+		"/api/v1/broker/collect/agent/process",
+		"/api/v1/broker/other",
+		"/api/v1/broker/collect/agent/process",
+		"/api/v1/broker/audit/event",
+	} {
+		if err = tun.OnewayJSON(ctx, path, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := tun.Outbox().Stats(); st.Depth != 3 || st.Dropped != 0 {
+		t.Fatalf("队列统计错误：%+v", st)
+	}
+
+	// 重连后按照优先级与入队顺序重放
+	want := []string{
+		"/api/v1/broker/audit/event 4\n",
+		"/api/v1/broker/other 2\n",
+		"/api/v1/broker/collect/agent/process 3\n",
+	}
+	for _, w := range want {
+		select {
+		case got := <-reports:
+			if got != w {
+				t.Fatalf("期望重放 %q，实际 %q", w, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("等待重放超时")
+		}
+	}
+	for i := 0; i < 50 && tun.Outbox().Len() != 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := tun.Outbox().Len(); n != 0 {
+		t.Fatalf("重放后队列应为空，实际 %d", n)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	var fails atomic.Int32
+	reports := make(chan string, 8)
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/audit/event", func(w http.ResponseWriter, r *http.Request) {
+		if fails.Add(1) <= 2 { // 前两次 broker 异常
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		reports <- string(body)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithBackoff(fastBackoff{}),
+		tunnel.WithOutbox(tunnel.OutboxConfig{Dir: t.TempDir()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	events := tun.Subscribe(ctx)
+	brk.CloseSessions()
+	for evt := range events {
+		if evt.To == tunnel.StateDisconnected {
+			break
+		}
+	}
+	if err = tun.OnewayJSON(ctx, "/api/v1/broker/audit/event", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重连后重放遇到 5xx，之后不需要再次重连或新的上报也会定时重试。
+	select {
+	case got := <-reports:
+		if got != "2\n" {
+			t.Fatalf("重放错误：%q", got)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("等待定时重试超时")
+	}
+}
+
+// 通道正常时 broker 响应 5xx 的上报同样入队重试，4xx 直接返回错误。
+func TestOutboxServerError(t *testing.T) {
+	var fails atomic.Int32
+	reports := make(chan string, 8)
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/audit/event", func(w http.ResponseWriter, r *http.Request) {
+		if fails.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		reports <- string(body)
+	})
+	h.HandleFunc("/api/v1/broker/audit/reject", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil,
+		tunnel.WithIdentifier(new(machineID)),
+		tunnel.WithOutbox(tunnel.OutboxConfig{Dir: t.TempDir()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	var he *netutil.HTTPError
+	if err = tun.OnewayJSON(ctx, "/api/v1/broker/audit/reject", 1); !errors.As(err, &he) || he.Code != http.StatusBadRequest {
+		t.Fatalf("4xx 应直接返回错误，实际：%v", err)
+	}
+	if err = tun.OnewayJSON(ctx, "/api/v1/broker/audit/event", 2); err != nil {
+		t.Fatalf("5xx 应入队重试，实际：%v", err)
+	}
+
+	select {
+	case got := <-reports:
+		if got != "2\n" {
+			t.Fatalf("重放错误：%q", got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("等待重放超时")
+	}
+}
@@ -0,0 +1,100 @@
+package tunneltest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestServices(t *testing.T) {
+	brk := NewBroker(nil)
+	defer brk.Close()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, exx := echo.Accept()
+			if exx != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); _ = conn.Close() }()
+		}
+	}()
+
+	mux := tunnel.NewMux(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), mux, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	audits := make(chan tunnel.ServiceAudit, 8)
+	reg := tun.Services()
+	reg.SetAudit(func(evt tunnel.ServiceAudit) { audits <- evt })
+	if err = reg.Register("echo", "tcp", echo.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle(tunnel.ServicePreface, reg)
+
+	sess := <-brk.Sessions
+	conn, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tunnel.DialService(conn, "echo"); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("访问本地服务错误：%q %v", buf, err)
+	}
+	_ = conn.Close()
+
+	if evt := <-audits; evt.Name != "echo" || !evt.End.IsZero() {
+		t.Fatalf("会话开始审计错误：%+v", evt)
+	}
+	select {
+	case evt := <-audits:
+		if evt.End.IsZero() || evt.Sent != 5 || evt.Received != 5 {
+			t.Fatalf("会话结束审计错误：%+v", evt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待会话结束审计超时")
+	}
+
+	// 未注册的服务不允许访问。
+	conn, err = sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = tunnel.DialService(conn, "ssh"); !errors.Is(err, tunnel.ErrServiceRejected) {
+		t.Fatalf("期望拒绝访问，实际：%v", err)
+	}
+	if evt := <-audits; !errors.Is(evt.Err, tunnel.ErrServiceRejected) {
+		t.Fatalf("拒绝访问审计错误：%+v", evt)
+	}
+
+	// 运行期间修改访问控制，已注册的服务也会被拒绝。
+	reg.SetAllow(func(string, tunnel.StreamMeta) bool { return false })
+	denied, err := sess.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	if err = tunnel.DialService(denied, "echo"); !errors.Is(err, tunnel.ErrServiceRejected) {
+		t.Fatalf("期望拒绝访问，实际：%v", err)
+	}
+}
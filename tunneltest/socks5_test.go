@@ -0,0 +1,166 @@
+package tunneltest
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+func TestSOCKS5(t *testing.T) {
+	h := http.NewServeMux()
+	h.HandleFunc("/api/v1/broker/stream/tunnel", relayHandler)
+	brk := NewBroker(h)
+	defer brk.Close()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, exx := echo.Accept()
+			if exx != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(conn, conn); _ = conn.Close() }()
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(new(machineID)), tunnel.WithBackoff(fastBackoff{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := tunnel.NewSOCKS5Server(tun)
+	srv.Users = map[string]string{"ops": "secret"}
+	srv.Deny = []string{"127.0.0.2"}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	// 密码错误
+	conn, rd := socksDial(t, ln.Addr().String())
+	if code := socksAuth(t, conn, rd, "ops", "wrong"); code == 0x00 {
+		t.Fatal("错误的密码通过了认证")
+	}
+	_ = conn.Close()
+
+	// 被 Deny 规则拒绝
+	conn, rd = socksDial(t, ln.Addr().String())
+	if code := socksAuth(t, conn, rd, "ops", "secret"); code != 0x00 {
+		t.Fatalf("认证失败：%d", code)
+	}
+	if code := socksConnect(t, conn, rd, "127.0.0.2", 80); code != 0x02 {
+		t.Fatalf("期望被规则拒绝，应答码：%d", code)
+	}
+	_ = conn.Close()
+
+	// 域名目标不能绕过 IP 规则
+	loop, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := tunnel.NewSOCKS5Server(tun)
+	strict.Deny = []string{"127.0.0.0/8", "::1"}
+	go func() { _ = strict.Serve(loop) }()
+	defer strict.Close()
+	conn, rd = socksDial(t, loop.Addr().String())
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+	if _, err = io.ReadFull(rd, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if code := socksConnect(t, conn, rd, "localhost", 80); code != 0x02 {
+		t.Fatalf("域名目标绕过了 IP 规则，应答码：%d", code)
+	}
+	_ = conn.Close()
+
+	// 正常转发
+	conn, rd = socksDial(t, ln.Addr().String())
+	defer conn.Close()
+	if code := socksAuth(t, conn, rd, "ops", "secret"); code != 0x00 {
+		t.Fatalf("认证失败：%d", code)
+	}
+	addr := echo.Addr().(*net.TCPAddr)
+	if code := socksConnect(t, conn, rd, addr.IP.String(), addr.Port); code != 0x00 {
+		t.Fatalf("CONNECT 失败，应答码：%d", code)
+	}
+	_, _ = conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(rd, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("SOCKS5 转发错误：%q %v", buf, err)
+	}
+
+	stats := srv.Stats()
+	for i := 0; i < 50 && stats[addr.String()].Received != 5; i++ { // 等待计数完成
+		time.Sleep(20 * time.Millisecond)
+		stats = srv.Stats()
+	}
+	if st := stats["127.0.0.2:80"]; st.Rejected != 1 {
+		t.Fatalf("拒绝次数统计错误：%+v", st)
+	}
+	if st := stats[addr.String()]; st.Conns != 1 || st.Sent != 5 || st.Received != 5 {
+		t.Fatalf("连接统计错误：%+v", st)
+	}
+}
+
+func socksDial(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return conn, bufio.NewReader(conn)
+}
+
+// socksAuth 协商用户名密码认证，返回认证状态码。
+func socksAuth(t *testing.T, conn net.Conn, rd *bufio.Reader, username, passwd string) byte {
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x02})
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(rd, resp); err != nil || resp[1] != 0x02 {
+		t.Fatalf("认证方式协商失败：%v %v", resp, err)
+	}
+
+	req := append([]byte{0x01, byte(len(username))}, username...)
+	req = append(req, byte(len(passwd)))
+	req = append(req, passwd...)
+	_, _ = conn.Write(req)
+	if _, err := io.ReadFull(rd, resp); err != nil {
+		return 0xff
+	}
+
+	return resp[1]
+}
+
+// socksConnect 发送 CONNECT 请求，返回应答码。host 为 IPv4 地址或域名。
+func socksConnect(t *testing.T, conn net.Conn, rd *bufio.Reader, host string, port int) byte {
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		req = append(append(req, 0x01), ip...)
+	} else {
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, _ = conn.Write(req)
+
+	resp := make([]byte, 10)
+	if _, err := io.ReadFull(rd, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	return resp[1]
+}
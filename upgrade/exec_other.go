@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package upgrade
+
+import "errors"
+
+func execve(string, []string, []string) error {
+	return errors.ErrUnsupported
+}
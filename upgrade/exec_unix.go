@@ -0,0 +1,9 @@
+//go:build unix
+
+package upgrade
+
+import "syscall"
+
+func execve(argv0 string, argv, envv []string) error {
+	return syscall.Exec(argv0, argv, envv)
+}
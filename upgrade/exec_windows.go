@@ -0,0 +1,21 @@
+//go:build windows
+
+package upgrade
+
+import (
+	"os"
+	"os/exec"
+)
+
+// execve Windows 不支持替换当前进程，启动新进程后退出当前进程。
+func execve(argv0 string, argv, envv []string) error {
+	cmd := exec.Command(argv0, argv[1:]...)
+	cmd.Env = envv
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+
+	return nil
+}
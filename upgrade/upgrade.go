@@ -0,0 +1,238 @@
+// Package upgrade 实现了 agent 的自升级：经由通道下载新版本（/api/v1/broker/upgrade/download），
+// 校验文件哈希与隐写的 manifest.json，原子地替换当前可执行文件，最后重新执行自身。
+//
+//	func (callbacks) NoticeUpgrade(ctx context.Context, notice *agentapi.UpgradeNotice) error {
+//		hide, _ := tunnel.ReadHide()
+//		up := upgrade.New(tun)
+//		err := up.Upgrade(ctx, upgrade.Request{Version: notice.Version, Tags: hide.Tags})
+//		if errors.Is(err, upgrade.ErrNoUpdate) {
+//			return nil
+//		}
+//		return err
+//	}
+//
+// 新版本启动后运行正常时调用 Cleanup 删除备份，启动异常时调用 Rollback 恢复旧版本。
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/vela-ssoc/vela-common-mba/definition"
+	"github.com/vela-ssoc/vela-common-mba/netutil"
+	"github.com/vela-ssoc/vela-tunnel"
+)
+
+var (
+	// ErrNoUpdate 没有可用的更新（broker 响应 304 或 204）。
+	ErrNoUpdate = errors.New("没有可用的更新")
+
+	// ErrManifest 新版本隐写的元数据与期望不一致。
+	ErrManifest = errors.New("升级包元数据校验失败")
+)
+
+// Request 检查更新的参数。
+type Request struct {
+	Version string   // 要升级到的版本，为空代表升级到最新版
+	Tags    []string // 隐写在二进制文件中的标签，一般为当前程序 ReadHide 读取到的 Tags
+}
+
+// Release 下载并校验通过的新版本。
+type Release struct {
+	Path string           // 新版本文件路径，位于可执行文件同目录下，保证可以原子地重命名
+	Hide definition.MHide // 新版本隐写的元数据
+}
+
+// Upgrader 自升级工具，导出的字段都有默认值，需要修改时请在使用前设置。
+type Upgrader struct {
+	// Executable 要替换的可执行文件，默认为当前程序（os.Executable）。
+	Executable string
+
+	// Goos Arch 新版本必须匹配的操作系统与 CPU 架构，默认为 runtime.GOOS runtime.GOARCH。
+	Goos string
+	Arch string
+
+	// Progress 下载进度回调，可以为 nil。
+	Progress tunnel.DownloadProgress
+
+	// Exec 替换成功后重新执行程序，参数同 syscall.Exec。
+	// 默认在 unix 下调用 syscall.Exec，在 Windows 下启动新进程后退出当前进程。
+	// 测试时可以替换为不会真正执行的函数。
+	Exec func(argv0 string, argv, envv []string) error
+
+	tun tunnel.Tunneler
+}
+
+// New 创建自升级工具。
+func New(tun tunnel.Tunneler) *Upgrader {
+	return &Upgrader{
+		Goos: runtime.GOOS,
+		Arch: runtime.GOARCH,
+		Exec: execve,
+		tun:  tun,
+	}
+}
+
+// Upgrade 下载、校验、替换并重新执行程序。没有可用的更新时返回 ErrNoUpdate。
+// 重新执行成功时不会返回（unix），重新执行失败时会回滚至旧版本并返回错误。
+func (u *Upgrader) Upgrade(ctx context.Context, req Request) error {
+	rel, err := u.Download(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err = u.Install(rel); err != nil {
+		return err
+	}
+	if err = u.Restart(); err != nil {
+		if exx := u.Rollback(); exx != nil {
+			return errors.Join(err, exx)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Download 下载新版本并校验，没有可用的更新时返回 ErrNoUpdate。
+//
+// 文件的 MD5 由 DownloadFile 根据 broker 响应的 hash 校验，broker 没有响应 hash 时
+// 返回 tunnel.ErrNoChecksum，不会使用未经校验的文件。隐写的元数据要求：
+// Goos Arch 与 Upgrader 一致，指定了 req.Version 时 Semver 必须与之相同。
+// 校验失败时会删除下载的文件。
+func (u *Upgrader) Download(ctx context.Context, req Request) (*Release, error) {
+	exe, err := u.executable()
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{"tags": req.Tags}
+	if req.Version != "" {
+		q.Set("version", req.Version)
+	}
+	dest := exe + ".upgrade"
+	err = u.tun.DownloadFile(ctx, "/api/v1/broker/upgrade/download?"+q.Encode(), dest, u.Progress, tunnel.RequireChecksum())
+	var he *netutil.HTTPError
+	if errors.As(err, &he) && (he.Code == http.StatusNotModified || he.Code == http.StatusNoContent) {
+		return nil, ErrNoUpdate
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hide, err := tunnel.ReadHide(dest)
+	if err == nil {
+		err = u.verify(hide, req)
+	}
+	if err != nil {
+		_ = os.Remove(dest)
+		return nil, err
+	}
+
+	return &Release{Path: dest, Hide: hide}, nil
+}
+
+func (u *Upgrader) verify(hide definition.MHide, req Request) error {
+	if hide.Goos != u.Goos || hide.Arch != u.Arch {
+		return fmt.Errorf("%w：期望 %s/%s，实际 %s/%s", ErrManifest, u.Goos, u.Arch, hide.Goos, hide.Arch)
+	}
+	if hide.Semver == "" {
+		return fmt.Errorf("%w：缺少版本号", ErrManifest)
+	}
+	if req.Version != "" && hide.Semver != req.Version {
+		return fmt.Errorf("%w：期望版本 %s，实际 %s", ErrManifest, req.Version, hide.Semver)
+	}
+
+	return nil
+}
+
+// Install 将当前可执行文件备份为 Executable + ".old"，然后原子地替换为新版本，
+// 替换失败时会恢复旧版本。
+func (u *Upgrader) Install(rel *Release) error {
+	exe, err := u.executable()
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(rel.Path, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	// 优先使用硬链接备份，替换的过程中 exe 始终存在；
+	// 不支持硬链接时（例如 Windows 上正在运行的程序不能被覆盖）只能先将旧文件重命名。
+	backup := exe + ".old"
+	_ = os.Remove(backup)
+	linked := os.Link(exe, backup) == nil
+	if !linked {
+		if err = os.Rename(exe, backup); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(rel.Path, exe); err != nil {
+		if linked {
+			_ = os.Remove(backup)
+		} else {
+			_ = os.Rename(backup, exe)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Restart 使用当前的参数与环境变量重新执行 Executable。
+func (u *Upgrader) Restart() error {
+	exe, err := u.executable()
+	if err != nil {
+		return err
+	}
+
+	return u.Exec(exe, os.Args, os.Environ())
+}
+
+// Rollback 使用 Install 时的备份恢复旧版本。
+func (u *Upgrader) Rollback() error {
+	exe, err := u.executable()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(exe+".old", exe)
+}
+
+// Cleanup 删除 Install 时的备份以及遗留的升级文件，新版本运行正常后调用。
+func (u *Upgrader) Cleanup() error {
+	exe, err := u.executable()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, name := range []string{exe + ".old", exe + ".upgrade", exe + ".upgrade.download", exe + ".upgrade.download.meta"} {
+		if exx := os.Remove(name); exx != nil && !errors.Is(exx, os.ErrNotExist) {
+			errs = append(errs, exx)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (u *Upgrader) executable() (string, error) {
+	if u.Executable != "" {
+		return u.Executable, nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.EvalSymlinks(exe)
+}
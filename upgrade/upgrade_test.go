@@ -0,0 +1,145 @@
+package upgrade_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/vela-ssoc/vela-common-mba/definition"
+	"github.com/vela-ssoc/vela-tunnel"
+	"github.com/vela-ssoc/vela-tunnel/tunneltest"
+	"github.com/vela-ssoc/vela-tunnel/upgrade"
+)
+
+type machineID struct{}
+
+func (machineID) MachineID(bool) string { return "upgrade" }
+
+// release 构造隐写了 manifest.json 的新版本。
+func release(t *testing.T, hide definition.MHide) []byte {
+	buf := bytes.NewBufferString("#!new-binary\n")
+	if err := tunnel.AddManifest(buf, hide, int64(buf.Len())); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestUpgrade(t *testing.T) {
+	hide := definition.MHide{Semver: "1.2.3", Goos: runtime.GOOS, Arch: runtime.GOARCH}
+	latest := release(t, hide)
+	hide.Arch = "mips"
+	mips := release(t, hide)
+
+	h := http.NewServeMux()
+	h.HandleFunc("GET /api/v1/broker/upgrade/download", func(w http.ResponseWriter, r *http.Request) {
+		if tags := r.URL.Query()["tags"]; len(tags) != 1 || tags[0] != "centos7" {
+			http.Error(w, "tags 错误", http.StatusBadRequest)
+			return
+		}
+		body := latest
+		switch r.URL.Query().Get("version") {
+		case "", "1.2.3":
+		case "0.0.1":
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case "mips":
+			body = mips
+		case "nohash":
+			_, _ = w.Write(latest)
+			return
+		}
+		sum := md5.Sum(body)
+		w.Header().Set("Content-Disposition", `attachment; filename="agent"; hash="`+hex.EncodeToString(sum[:])+`"`)
+		_, _ = w.Write(body)
+	})
+	brk := tunneltest.NewBroker(h)
+	defer brk.Close()
+
+	ctx := context.Background()
+	tun, err := tunnel.Dial(ctx, brk.Hide(), nil, tunnel.WithIdentifier(machineID{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	exe := filepath.Join(t.TempDir(), "agent")
+	if err = os.WriteFile(exe, []byte("#!old-binary\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	var execs []string
+	execErr := errors.New("exec format error")
+	up := upgrade.New(tun)
+	up.Executable = exe
+	up.Exec = func(argv0 string, _, _ []string) error {
+		execs = append(execs, argv0)
+		if len(execs) > 1 {
+			return execErr
+		}
+		return nil
+	}
+	tags := []string{"centos7"}
+
+	if err = up.Upgrade(ctx, upgrade.Request{Version: "0.0.1", Tags: tags}); !errors.Is(err, upgrade.ErrNoUpdate) {
+		t.Fatalf("期望 ErrNoUpdate，实际：%v", err)
+	}
+	for _, version := range []string{"mips", "1.0.0"} {
+		if err = up.Upgrade(ctx, upgrade.Request{Version: version, Tags: tags}); !errors.Is(err, upgrade.ErrManifest) {
+			t.Fatalf("版本 %s 期望 ErrManifest，实际：%v", version, err)
+		}
+	}
+	if err = up.Upgrade(ctx, upgrade.Request{Version: "nohash", Tags: tags}); !errors.Is(err, tunnel.ErrNoChecksum) {
+		t.Fatalf("没有 hash 时期望 ErrNoChecksum，实际：%v", err)
+	}
+	if _, err = os.Stat(exe + ".upgrade.download"); !os.IsNotExist(err) {
+		t.Fatalf("未经校验的文件应被删除：%v", err)
+	}
+	if len(execs) != 0 {
+		t.Fatalf("校验失败时不应该重新执行：%v", execs)
+	}
+	assertFile(t, exe, "#!old-binary\n")
+
+	if err = up.Upgrade(ctx, upgrade.Request{Tags: tags}); err != nil {
+		t.Fatal(err)
+	}
+	if len(execs) != 1 || execs[0] != exe {
+		t.Fatalf("重新执行错误：%v", execs)
+	}
+	assertFile(t, exe, string(latest))
+	assertFile(t, exe+".old", "#!old-binary\n")
+	if info, _ := os.Stat(exe); info.Mode().Perm() != 0o755 {
+		t.Fatalf("文件权限错误：%s", info.Mode())
+	}
+	if err = up.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(exe + ".old"); !os.IsNotExist(err) {
+		t.Fatalf("备份文件未删除：%v", err)
+	}
+
+	// 重新执行失败时回滚
+	if err = os.WriteFile(exe, []byte("#!old-binary\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err = up.Upgrade(ctx, upgrade.Request{Version: "1.2.3", Tags: tags}); !errors.Is(err, execErr) {
+		t.Fatalf("期望重新执行失败，实际：%v", err)
+	}
+	assertFile(t, exe, "#!old-binary\n")
+}
+
+func assertFile(t *testing.T, name, want string) {
+	t.Helper()
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatalf("%s 内容错误：%q", name, got)
+	}
+}